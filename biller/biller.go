@@ -0,0 +1,83 @@
+// Package biller talks to the billers behind bill-payment products. A
+// product names its biller adapter, and payments go through a two-step
+// inquiry then pay.
+package biller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+var (
+	ErrUnknownBiller    = errors.New("unknown biller")
+	ErrCustomerNotFound = errors.New("customer not found")
+	ErrAlreadyPaid      = errors.New("bill already paid")
+	ErrAmountMismatch   = errors.New("amount does not match the bill")
+	ErrUnavailable      = errors.New("biller unavailable")
+)
+
+// Bill is what a customer owes for a product, as reported by inquiry.
+type Bill struct {
+	CustomerNumber string       `json:"customer_number"`
+	CustomerName   string       `json:"customer_name"`
+	Amount         models.Money `json:"amount"`
+	// Period is the billing period, empty for prepaid products.
+	Period string `json:"period"`
+}
+
+// Receipt is the biller's proof of payment. Token is set for prepaid
+// products such as PLN electricity.
+type Receipt struct {
+	Reference string  `json:"reference"`
+	Token     *string `json:"token"`
+}
+
+// Biller is an adapter to one biller. Pay must be idempotent on reference,
+// returning the first receipt when the same reference is paid again.
+type Biller interface {
+	Inquire(ctx context.Context, productCode, customerNumber string) (*Bill, error)
+	Pay(ctx context.Context, productCode string, bill Bill, reference string) (*Receipt, error)
+}
+
+// Registry holds the adapters products name, by name.
+type Registry struct {
+	mu       sync.RWMutex
+	adapters map[string]Biller
+}
+
+func NewRegistry() *Registry {
+	return &Registry{adapters: make(map[string]Biller)}
+}
+
+// Register makes b available under name, replacing any adapter registered
+// before.
+func (r *Registry) Register(name string, b Biller) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.adapters[name] = b
+}
+
+// Get returns the adapter registered under name.
+func (r *Registry) Get(name string) (Biller, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.adapters[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBiller, name)
+	}
+	return b, nil
+}
+
+// RegisterMock registers the mock adapter loaded from path as "mock".
+func (r *Registry) RegisterMock(path string) error {
+	mock, err := LoadMock(path)
+	if err != nil {
+		return err
+	}
+	r.Register("mock", mock)
+	return nil
+}
@@ -0,0 +1,125 @@
+package biller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+// MockCustomer is one customer of the mock biller file.
+type MockCustomer struct {
+	Name   string       `json:"name"`
+	Amount models.Money `json:"amount"`
+	Period string       `json:"period"`
+	// Token issues a prepaid token on payment.
+	Token bool `json:"token"`
+	// Fail makes payment fail as if the biller were down.
+	Fail bool `json:"fail"`
+}
+
+// Mock is a local biller driven by a JSON file of product code to customer
+// number to MockCustomer, for development and tests. Paid bills are kept in
+// memory, so a restart makes every bill due again.
+type Mock struct {
+	customers map[string]map[string]MockCustomer
+
+	mu       sync.Mutex
+	paid     map[string]string // product code and customer number to reference
+	receipts map[string]*Receipt
+}
+
+// LoadMock reads a mock biller file.
+func LoadMock(path string) (*Mock, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var customers map[string]map[string]MockCustomer
+	if err := json.Unmarshal(b, &customers); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewMock(customers), nil
+}
+
+func NewMock(customers map[string]map[string]MockCustomer) *Mock {
+	return &Mock{
+		customers: customers,
+		paid:      make(map[string]string),
+		receipts:  make(map[string]*Receipt),
+	}
+}
+
+func (m *Mock) Inquire(ctx context.Context, productCode, customerNumber string) (*Bill, error) {
+	customer, ok := m.customers[productCode][customerNumber]
+	if !ok {
+		return nil, ErrCustomerNotFound
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, paid := m.paid[productCode+"/"+customerNumber]; paid && !customer.Token {
+		return nil, ErrAlreadyPaid
+	}
+
+	return &Bill{
+		CustomerNumber: customerNumber,
+		CustomerName:   customer.Name,
+		Amount:         customer.Amount,
+		Period:         customer.Period,
+	}, nil
+}
+
+func (m *Mock) Pay(ctx context.Context, productCode string, bill Bill, reference string) (*Receipt, error) {
+	customer, ok := m.customers[productCode][bill.CustomerNumber]
+	if !ok {
+		return nil, ErrCustomerNotFound
+	}
+	if customer.Fail {
+		return nil, ErrUnavailable
+	}
+	if bill.Amount != customer.Amount {
+		return nil, ErrAmountMismatch
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if receipt, ok := m.receipts[reference]; ok {
+		return receipt, nil
+	}
+	key := productCode + "/" + bill.CustomerNumber
+	if _, paid := m.paid[key]; paid && !customer.Token {
+		return nil, ErrAlreadyPaid
+	}
+
+	receipt := &Receipt{Reference: "MOCK-" + uuid.NewString()}
+	if customer.Token {
+		token, err := mockToken()
+		if err != nil {
+			return nil, err
+		}
+		receipt.Token = &token
+	}
+	m.paid[key] = reference
+	m.receipts[reference] = receipt
+	return receipt, nil
+}
+
+// mockToken returns a 20 digit token formatted like a PLN prepaid token.
+func mockToken() (string, error) {
+	digits := ""
+	for len(digits) < 20 {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits += n.String()
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", digits[0:4], digits[4:8], digits[8:12], digits[12:16], digits[16:20]), nil
+}
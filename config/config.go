@@ -1,18 +1,484 @@
+// Package config loads the application's settings once at startup into a
+// typed Config. Values come from the defaults, then an optional YAML file,
+// then the environment, which an optional .env file adds to; later sources
+// win. The result is validated before anything is started.
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ilhamosaurus/fiber-commerce/models"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
-func Config(key string) string {
-	// load env
-	err := godotenv.Load(".env")
+// DefaultFile is the YAML file read when CONFIG_FILE is not set. Unlike a
+// file named by CONFIG_FILE, it may be missing.
+const DefaultFile = "config.yaml"
+
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Database Database `yaml:"database"`
+	JWT      JWT      `yaml:"jwt"`
+	CORS     CORS     `yaml:"cors"`
+	Limits   Limits   `yaml:"limits"`
+	Auth     Auth     `yaml:"auth"`
+	Mail     Mail     `yaml:"mail"`
+	Invoice  Invoice  `yaml:"invoice"`
+	Billing  Billing  `yaml:"billing"`
+}
+
+type Server struct {
+	Port int `yaml:"port"`
+	// ProxyHeader is the header a reverse proxy puts the client address
+	// in, e.g. X-Forwarded-For; login throttling counts per address.
+	ProxyHeader string `yaml:"proxy_header"`
+	// AppURL is where links in emails point, none when empty.
+	AppURL string `yaml:"app_url"`
+	// RequestTimeout bounds reading a request and writing its response.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// Timezone is where the business day is counted, e.g. for the daily
+	// transfer limit.
+	Timezone string `yaml:"timezone"`
+}
+
+type Database struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"ssl_mode"`
+}
+
+// DSN is the Postgres connection string for d.
+func (d Database) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", d.Host, d.Port, d.User, d.Password, d.Name, d.SSLMode)
+}
+
+type JWT struct {
+	// SigningAlg is the algorithm of the key generated when PrivateKeyFile
+	// is empty, RS256 or EdDSA.
+	SigningAlg       string        `yaml:"signing_alg"`
+	PrivateKeyFile   string        `yaml:"private_key_file"`
+	PreviousKeyFiles []string      `yaml:"previous_key_files"`
+	Issuer           string        `yaml:"issuer"`
+	Audience         string        `yaml:"audience"`
+	AccessTokenTTL   time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL  time.Duration `yaml:"refresh_token_ttl"`
+}
+
+type CORS struct {
+	AllowOrigins     []string `yaml:"allow_origins"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+}
+
+type Limits struct {
+	// TransferMaxAmount and TransferDailyLimit are off when nil.
+	TransferMaxAmount  *models.Money `yaml:"transfer_max_amount"`
+	TransferDailyLimit *models.Money `yaml:"transfer_daily_limit"`
+	// StepUpThreshold is the amount from which users with two-factor
+	// authentication confirm transfers and payments; 0 turns it off.
+	StepUpThreshold models.Money  `yaml:"step_up_threshold"`
+	IdempotencyTTL  time.Duration `yaml:"idempotency_ttl"`
+	// IdempotencyLease is how long a request holds its Idempotency-Key
+	// before a retry may take over, so it outlasts RequestTimeout.
+	IdempotencyLease time.Duration `yaml:"idempotency_lease"`
+}
+
+type Auth struct {
+	TwoFactorChallengeTTL time.Duration `yaml:"two_factor_challenge_ttl"`
+	EmailVerificationTTL  time.Duration `yaml:"email_verification_ttl"`
+	PasswordResetTTL      time.Duration `yaml:"password_reset_ttl"`
+	LoginMaxAttempts      int           `yaml:"login_max_attempts"`
+	LoginIPMaxAttempts    int           `yaml:"login_ip_max_attempts"`
+	LoginAttemptWindow    time.Duration `yaml:"login_attempt_window"`
+	LoginLockout          time.Duration `yaml:"login_lockout"`
+	LoginMaxLockout       time.Duration `yaml:"login_max_lockout"`
+}
+
+type Mail struct {
+	// Mailer is "log", which writes mail to LogFile or the log, or "smtp".
+	Mailer       string `yaml:"mailer"`
+	From         string `yaml:"from"`
+	LogFile      string `yaml:"log_file"`
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     int    `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+}
+
+type Invoice struct {
+	Format     string `yaml:"format"`
+	Prefix     string `yaml:"prefix"`
+	DateFormat string `yaml:"date_format"`
+	Padding    int    `yaml:"padding"`
+	Timezone   string `yaml:"timezone"`
+}
+
+type Billing struct {
+	BillerMockFile   string          `yaml:"biller_mock_file"`
+	InquiryTTL       time.Duration   `yaml:"inquiry_ttl"`
+	SubscriptionTick time.Duration   `yaml:"subscription_tick"`
+	RetryDelays      []time.Duration `yaml:"retry_delays"`
+}
+
+// Default is the configuration before any file or variable is read.
+func Default() *Config {
+	return &Config{
+		Server:   Server{Port: 6012, RequestTimeout: 30 * time.Second, Timezone: "Asia/Jakarta"},
+		Database: Database{Port: 5432, SSLMode: "disable"},
+		JWT: JWT{
+			SigningAlg:      "RS256",
+			Issuer:          "fiber-commerce",
+			Audience:        "fiber-commerce",
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		CORS: CORS{AllowOrigins: []string{"*"}},
+		Limits: Limits{
+			StepUpThreshold:  models.NewMoney(5000000),
+			IdempotencyTTL:   24 * time.Hour,
+			IdempotencyLease: 2 * time.Minute,
+		},
+		Auth: Auth{
+			TwoFactorChallengeTTL: 5 * time.Minute,
+			EmailVerificationTTL:  24 * time.Hour,
+			PasswordResetTTL:      time.Hour,
+			LoginMaxAttempts:      5,
+			LoginIPMaxAttempts:    20,
+			LoginAttemptWindow:    15 * time.Minute,
+			LoginLockout:          time.Minute,
+			LoginMaxLockout:       time.Hour,
+		},
+		Mail: Mail{
+			Mailer:   "log",
+			From:     "no-reply@fiber-commerce.local",
+			SMTPPort: 587,
+		},
+		Invoice: Invoice{
+			Format:     "{prefix}{date}-{seq}",
+			Prefix:     "INV",
+			DateFormat: "02012006",
+			Padding:    4,
+			Timezone:   "Asia/Jakarta",
+		},
+		Billing: Billing{
+			BillerMockFile:   "biller/mock.json",
+			InquiryTTL:       15 * time.Minute,
+			SubscriptionTick: time.Minute,
+			RetryDelays:      []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour},
+		},
+	}
+}
+
+// Load reads and validates the configuration. A .env file in the working
+// directory is optional and never overrides variables already set.
+func Load() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+
+	cfg := Default()
+
+	path, named := os.LookupEnv("CONFIG_FILE")
+	if !named || path == "" {
+		path, named = DefaultFile, false
+	}
+	if err := cfg.readFile(path); err != nil {
+		if named || !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if err := cfg.readEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile overlays the YAML file at path. Unknown keys are an error, so a
+// misspelt setting is not silently ignored.
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// readEnv overlays the variables lookup finds. Empty variables count as
+// unset, like the blank lines of .env.example.
+func (c *Config) readEnv(lookup func(string) (string, bool)) error {
+	errs := make([]error, 0)
+	for _, v := range c.variables() {
+		value, ok := lookup(v.name)
+		if !ok || strings.TrimSpace(value) == "" {
+			continue
+		}
+		if err := v.set(strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type variable struct {
+	name string
+	set  func(string) error
+}
+
+// variables are the environment variables and the settings they fill.
+func (c *Config) variables() []variable {
+	return []variable{
+		{"PORT", setInt(&c.Server.Port)},
+		{"PROXY_HEADER", setString(&c.Server.ProxyHeader)},
+		{"APP_URL", setString(&c.Server.AppURL)},
+		{"REQUEST_TIMEOUT", setDuration(&c.Server.RequestTimeout)},
+		{"TIMEZONE", setString(&c.Server.Timezone)},
+
+		{"DB_HOST", setString(&c.Database.Host)},
+		{"DB_PORT", setInt(&c.Database.Port)},
+		{"DB_USER", setString(&c.Database.User)},
+		{"DB_PASSWORD", setString(&c.Database.Password)},
+		{"DB_NAME", setString(&c.Database.Name)},
+		{"DB_SSLMODE", setString(&c.Database.SSLMode)},
+
+		{"JWT_SIGNING_ALG", setString(&c.JWT.SigningAlg)},
+		{"JWT_PRIVATE_KEY_FILE", setString(&c.JWT.PrivateKeyFile)},
+		{"JWT_PREVIOUS_KEY_FILES", setList(&c.JWT.PreviousKeyFiles)},
+		{"JWT_ISSUER", setString(&c.JWT.Issuer)},
+		{"JWT_AUDIENCE", setString(&c.JWT.Audience)},
+		{"ACCESS_TOKEN_TTL", setDuration(&c.JWT.AccessTokenTTL)},
+		{"REFRESH_TOKEN_TTL", setDuration(&c.JWT.RefreshTokenTTL)},
+
+		{"CORS_ALLOW_ORIGINS", setList(&c.CORS.AllowOrigins)},
+		{"CORS_ALLOW_CREDENTIALS", setBool(&c.CORS.AllowCredentials)},
+
+		{"TRANSFER_MAX_AMOUNT", setOptionalMoney(&c.Limits.TransferMaxAmount)},
+		{"TRANSFER_DAILY_LIMIT", setOptionalMoney(&c.Limits.TransferDailyLimit)},
+		{"STEP_UP_THRESHOLD", setMoney(&c.Limits.StepUpThreshold)},
+		{"IDEMPOTENCY_TTL", setDuration(&c.Limits.IdempotencyTTL)},
+		{"IDEMPOTENCY_LEASE", setDuration(&c.Limits.IdempotencyLease)},
+
+		{"TWO_FACTOR_CHALLENGE_TTL", setDuration(&c.Auth.TwoFactorChallengeTTL)},
+		{"EMAIL_VERIFICATION_TTL", setDuration(&c.Auth.EmailVerificationTTL)},
+		{"PASSWORD_RESET_TTL", setDuration(&c.Auth.PasswordResetTTL)},
+		{"LOGIN_MAX_ATTEMPTS", setInt(&c.Auth.LoginMaxAttempts)},
+		{"LOGIN_IP_MAX_ATTEMPTS", setInt(&c.Auth.LoginIPMaxAttempts)},
+		{"LOGIN_ATTEMPT_WINDOW", setDuration(&c.Auth.LoginAttemptWindow)},
+		{"LOGIN_LOCKOUT", setDuration(&c.Auth.LoginLockout)},
+		{"LOGIN_MAX_LOCKOUT", setDuration(&c.Auth.LoginMaxLockout)},
+
+		{"MAILER", setString(&c.Mail.Mailer)},
+		{"MAIL_FROM", setString(&c.Mail.From)},
+		{"MAIL_LOG_FILE", setString(&c.Mail.LogFile)},
+		{"SMTP_HOST", setString(&c.Mail.SMTPHost)},
+		{"SMTP_PORT", setInt(&c.Mail.SMTPPort)},
+		{"SMTP_USERNAME", setString(&c.Mail.SMTPUsername)},
+		{"SMTP_PASSWORD", setString(&c.Mail.SMTPPassword)},
+
+		{"INVOICE_FORMAT", setString(&c.Invoice.Format)},
+		{"INVOICE_PREFIX", setString(&c.Invoice.Prefix)},
+		{"INVOICE_DATE_FORMAT", setString(&c.Invoice.DateFormat)},
+		{"INVOICE_PADDING", setInt(&c.Invoice.Padding)},
+		{"INVOICE_TIMEZONE", setString(&c.Invoice.Timezone)},
+
+		{"BILLER_MOCK_FILE", setString(&c.Billing.BillerMockFile)},
+		{"BILL_INQUIRY_TTL", setDuration(&c.Billing.InquiryTTL)},
+		{"SUBSCRIPTION_TICK", setDuration(&c.Billing.SubscriptionTick)},
+		{"SUBSCRIPTION_RETRY_DELAYS", setDurations(&c.Billing.RetryDelays)},
 	}
+}
+
+func setString(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*dst = n
+		return nil
+	}
+}
+
+func setBool(dst *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+func setDuration(dst *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*dst = d
+		return nil
+	}
+}
+
+func setMoney(dst *models.Money) func(string) error {
+	return func(v string) error {
+		m, err := models.ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*dst = m
+		return nil
+	}
+}
+
+func setOptionalMoney(dst **models.Money) func(string) error {
+	return func(v string) error {
+		m, err := models.ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*dst = &m
+		return nil
+	}
+}
+
+// setList reads a comma separated list.
+func setList(dst *[]string) func(string) error {
+	return func(v string) error {
+		list := make([]string, 0)
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		*dst = list
+		return nil
+	}
+}
+
+func setDurations(dst *[]time.Duration) func(string) error {
+	return func(v string) error {
+		list := make([]time.Duration, 0)
+		for _, s := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			list = append(list, d)
+		}
+		*dst = list
+		return nil
+	}
+}
+
+// Validate reports every setting that cannot work, so a bad deployment
+// fails at startup rather than on the first request that needs it.
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		check(d > 0, "%s must be positive, got %s", name, d)
+	}
+
+	check(validPort(c.Server.Port), "server port %d is out of range", c.Server.Port)
+	positive("request timeout", c.Server.RequestTimeout)
+	if _, err := time.LoadLocation(c.Server.Timezone); err != nil {
+		check(false, "timezone %q: %v", c.Server.Timezone, err)
+	}
+
+	check(c.Database.Host != "", "database host is required")
+	check(c.Database.User != "", "database user is required")
+	check(c.Database.Name != "", "database name is required")
+	check(validPort(c.Database.Port), "database port %d is out of range", c.Database.Port)
+
+	check(c.JWT.SigningAlg == "RS256" || c.JWT.SigningAlg == "EdDSA", "jwt signing alg %q is not RS256 or EdDSA", c.JWT.SigningAlg)
+	check(c.JWT.Issuer != "", "jwt issuer is required")
+	check(c.JWT.Audience != "", "jwt audience is required")
+	positive("access token ttl", c.JWT.AccessTokenTTL)
+	positive("refresh token ttl", c.JWT.RefreshTokenTTL)
+
+	check(len(c.CORS.AllowOrigins) > 0, "cors allow origins is required")
+	check(!c.CORS.AllowCredentials || !slices.Contains(c.CORS.AllowOrigins, "*"), "cors cannot allow credentials for every origin")
+
+	for name, limit := range map[string]*models.Money{"transfer max amount": c.Limits.TransferMaxAmount, "transfer daily limit": c.Limits.TransferDailyLimit} {
+		check(limit == nil || *limit > 0, "%s must be positive", name)
+	}
+	check(c.Limits.StepUpThreshold >= 0, "step up threshold cannot be negative")
+	positive("idempotency ttl", c.Limits.IdempotencyTTL)
+	// a lease running out while its request still runs lets a retry run the
+	// same request a second time
+	check(c.Limits.IdempotencyLease > c.Server.RequestTimeout, "idempotency lease %s must be longer than the request timeout %s", c.Limits.IdempotencyLease, c.Server.RequestTimeout)
+	check(c.Limits.IdempotencyLease <= c.Limits.IdempotencyTTL, "idempotency lease %s is longer than the idempotency ttl %s", c.Limits.IdempotencyLease, c.Limits.IdempotencyTTL)
+
+	positive("two factor challenge ttl", c.Auth.TwoFactorChallengeTTL)
+	positive("email verification ttl", c.Auth.EmailVerificationTTL)
+	positive("password reset ttl", c.Auth.PasswordResetTTL)
+	check(c.Auth.LoginMaxAttempts > 0, "login max attempts must be positive")
+	check(c.Auth.LoginIPMaxAttempts > 0, "login ip max attempts must be positive")
+	positive("login attempt window", c.Auth.LoginAttemptWindow)
+	positive("login lockout", c.Auth.LoginLockout)
+	check(c.Auth.LoginMaxLockout >= c.Auth.LoginLockout, "login max lockout is shorter than login lockout")
+
+	switch c.Mail.Mailer {
+	case "log":
+	case "smtp":
+		check(c.Mail.SMTPHost != "", "smtp host is required with the smtp mailer")
+		check(validPort(c.Mail.SMTPPort), "smtp port %d is out of range", c.Mail.SMTPPort)
+	default:
+		check(false, "mailer %q is not log or smtp", c.Mail.Mailer)
+	}
+	check(c.Mail.From != "", "mail from is required")
+
+	check(strings.Contains(c.Invoice.Format, "{seq}"), "invoice format %q has no {seq}", c.Invoice.Format)
+	check(c.Invoice.DateFormat != "", "invoice date format is required")
+	check(c.Invoice.Padding > 0, "invoice padding must be positive")
+	if _, err := time.LoadLocation(c.Invoice.Timezone); err != nil {
+		check(false, "invoice timezone %q: %v", c.Invoice.Timezone, err)
+	}
+
+	positive("bill inquiry ttl", c.Billing.InquiryTTL)
+	positive("subscription tick", c.Billing.SubscriptionTick)
+	check(len(c.Billing.RetryDelays) > 0, "subscription retry delays are required")
+	for _, d := range c.Billing.RetryDelays {
+		positive("subscription retry delay", d)
+	}
+
+	return errors.Join(errs...)
+}
 
-	return os.Getenv(key)
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
 }
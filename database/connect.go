@@ -3,39 +3,59 @@ package database
 import (
 	"fmt"
 	"log"
-	"strconv"
 
 	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
 	"github.com/ilhamosaurus/fiber-commerce/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-func ConnectDb() {
-	var err error
-	p := config.Config("DB_PORT")
-	port, err := strconv.ParseUint(p, 10, 32)
-	if err != nil {
-		panic("failed to parse database port")
-	}
-
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Config("DB_HOST"), port, config.Config("DB_USER"), config.Config("DB_PASSWORD"), config.Config("DB_NAME"))
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+// ConnectDb opens the database described by cfg and migrates it.
+func ConnectDb(cfg config.Database) *gorm.DB {
+	db, err := gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
+		// unique violations come back as gorm.ErrDuplicatedKey
+		TranslateError: true,
 	})
 	if err != nil {
 		log.Fatal("failed to connect database")
 	}
 
 	// init enum for role and order
-	db.Exec("CREATE TYPE role AS ENUM ('CLIENT', 'MERCHANT')")
-	db.Exec("CREATE TYPE order_type AS ENUM ('TOPUP', 'PAYMENT', 'REVENUE')")
+	db.Exec("CREATE TYPE role AS ENUM ('CLIENT', 'MERCHANT', 'ADMIN')")
+	db.Exec("ALTER TYPE role ADD VALUE IF NOT EXISTS 'ADMIN'")
+	db.Exec("CREATE TYPE order_type AS ENUM ('TOPUP', 'PAYMENT', 'REVENUE', 'REFUND', 'TRANSFER_OUT', 'TRANSFER_IN', 'ADJUSTMENT')")
+	db.Exec("ALTER TYPE order_type ADD VALUE IF NOT EXISTS 'REFUND'")
+	db.Exec("ALTER TYPE order_type ADD VALUE IF NOT EXISTS 'TRANSFER_OUT'")
+	db.Exec("ALTER TYPE order_type ADD VALUE IF NOT EXISTS 'TRANSFER_IN'")
+	db.Exec("ALTER TYPE order_type ADD VALUE IF NOT EXISTS 'ADJUSTMENT'")
+	db.Exec("CREATE TYPE posting_direction AS ENUM ('DEBIT', 'CREDIT')")
+	db.Exec("CREATE TYPE order_status AS ENUM ('PENDING', 'PAID', 'FULFILLED', 'COMPLETED', 'CANCELLED', 'REFUNDED')")
+	db.Exec("CREATE TYPE subscription_status AS ENUM ('ACTIVE', 'PAST_DUE', 'PAUSED', 'CANCELLED')")
+	db.Exec("CREATE TYPE billing_interval AS ENUM ('DAILY', 'WEEKLY', 'MONTHLY', 'YEARLY')")
+	db.Exec("CREATE TYPE token_purpose AS ENUM ('VERIFY_EMAIL', 'RESET_PASSWORD')")
 
 	fmt.Println("Connection Opened to Database")
-	db.AutoMigrate(&models.User{}, &models.Product{}, &models.Account{}, &models.Order{})
+	migrateMoneyColumns(db)
+	dropVariantSKUConstraint(db)
+	db.AutoMigrate(&models.User{}, &models.Category{}, &models.Product{}, &models.ProductVariant{}, &models.StockMovement{}, &models.Account{}, &models.Order{}, &models.OrderItem{}, &models.OrderStatusHistory{}, &models.Cart{}, &models.CartItem{}, &models.JournalEntry{}, &models.Posting{}, &models.IdempotencyKey{}, &models.InvoiceCounter{}, &models.BillInquiry{}, &models.Subscription{}, &models.SubscriptionCharge{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.RecoveryCode{}, &models.TwoFactorChallenge{}, &models.EmailToken{}, &models.LoginThrottle{}, &models.AuditEvent{}, &models.APIKey{})
+	dropCartItemProductIndex(db)
+	protectStatusHistory(db)
+	indexProducts(db)
 	fmt.Println("Database Migrated")
 	Load(db) // products seeding
-	DB = db
+
+	if err := ledger.OpenBalances(db); err != nil {
+		log.Fatal("failed to open ledger balances: ", err)
+	}
+	discrepancies, err := ledger.Check(db)
+	if err != nil {
+		log.Fatal("failed to check ledger: ", err)
+	}
+	for _, d := range discrepancies {
+		log.Printf("ledger: account %d (%s) cached balance %s differs from postings %s", d.AccountID, d.Owner, d.Cached, d.Posted)
+	}
+	return db
 }
@@ -0,0 +1,49 @@
+// Package dbtest opens the Postgres database tests run against. It is the
+// database the DB_* variables describe, but named by TEST_DB_NAME so tests
+// never touch the application's data; without TEST_DB_NAME the tests that
+// need it are skipped.
+package dbtest
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/database"
+	"gorm.io/gorm"
+)
+
+var (
+	once sync.Once
+	db   *gorm.DB
+	err  error
+)
+
+// Open returns the migrated test database, connecting on first use.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	name := os.Getenv("TEST_DB_NAME")
+	if name == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+	once.Do(func() {
+		var cfg *config.Config
+		os.Setenv("DB_NAME", name)
+		if cfg, err = config.Load(); err != nil {
+			return
+		}
+		db = database.ConnectDb(cfg.Database)
+	})
+	if err != nil {
+		t.Fatalf("test database config: %v", err)
+	}
+	return db
+}
+
+// Name returns prefix with a random suffix, for rows that must not collide
+// with those of earlier runs.
+func Name(prefix string) string {
+	return prefix + uuid.NewString()[:8]
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"gorm.io/gorm"
+)
+
+// moneyColumns used to be numeric(10,2) and now hold models.Money minor units.
+var moneyColumns = []struct {
+	Table  string
+	Column string
+}{
+	{"accounts", "balance"},
+	{"orders", "amount"},
+	{"products", "price"},
+}
+
+// migrateMoneyColumns converts legacy numeric money columns to bigint minor
+// units. AutoMigrate would only cast the type and silently drop the cents,
+// so the conversion is done here before it runs.
+func migrateMoneyColumns(db *gorm.DB) {
+	for _, c := range moneyColumns {
+		var dataType string
+		if err := db.Raw("SELECT data_type FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?", c.Table, c.Column).Scan(&dataType).Error; err != nil {
+			log.Fatal(err)
+		}
+		if dataType != "numeric" {
+			continue
+		}
+
+		sql := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE bigint USING round(%s * %d)::bigint", c.Table, c.Column, c.Column, models.MinorUnits)
+		if err := db.Exec(sql).Error; err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Migrated %s.%s to minor units\n", c.Table, c.Column)
+	}
+}
+
+// protectStatusHistory makes order_status_histories append-only at the
+// database level, so not even a bug in a handler can rewrite it.
+func protectStatusHistory(db *gorm.DB) {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION reject_status_history_change() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'order_status_histories is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		"DROP TRIGGER IF EXISTS order_status_histories_append_only ON order_status_histories",
+		"CREATE TRIGGER order_status_histories_append_only BEFORE UPDATE OR DELETE ON order_status_histories FOR EACH ROW EXECUTE FUNCTION reject_status_history_change()",
+	}
+	for _, sql := range statements {
+		if err := db.Exec(sql).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// indexProducts adds the indexes behind product search and sorting. Search
+// matches substrings of name and code, which pg_trgm GIN indexes serve;
+// without the extension search still works, just with a sequential scan.
+func indexProducts(db *gorm.DB) {
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm unavailable, product search will not be indexed: %v", err)
+	} else {
+		for _, sql := range []string{
+			"CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING gin (name gin_trgm_ops)",
+			"CREATE INDEX IF NOT EXISTS idx_products_code_trgm ON products USING gin (code gin_trgm_ops)",
+		} {
+			if err := db.Exec(sql).Error; err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// keyset pagination orders by the sort column, then id
+	for _, sql := range []string{
+		"CREATE INDEX IF NOT EXISTS idx_products_price_id ON products (price, id)",
+		"CREATE INDEX IF NOT EXISTS idx_products_name_id ON products (name, id)",
+		"CREATE INDEX IF NOT EXISTS idx_products_created_at_id ON products (created_at, id)",
+		"CREATE INDEX IF NOT EXISTS idx_products_merchant ON products (merchant)",
+	} {
+		if err := db.Exec(sql).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dropCartItemProductIndex removes the cart item index from before variants,
+// which allowed each product only once per cart whatever the variant.
+func dropCartItemProductIndex(db *gorm.DB) {
+	if db.Migrator().HasIndex(&models.CartItem{}, "idx_cart_item_product") {
+		if err := db.Migrator().DropIndex(&models.CartItem{}, "idx_cart_item_product"); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dropVariantSKUConstraint removes the unique constraint SKUs had before it
+// became a partial index over live variants; it also counted deleted ones.
+func dropVariantSKUConstraint(db *gorm.DB) {
+	for _, name := range []string{"uni_product_variants_sku", "product_variants_sku_key"} {
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE IF EXISTS product_variants DROP CONSTRAINT IF EXISTS %s", name)).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -6,77 +6,121 @@ import (
 	"github.com/ilhamosaurus/fiber-commerce/models"
 	"github.com/ilhamosaurus/fiber-commerce/util"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var products = []models.Product{
 	{
 		Code:     "PAJAK",
 		Name:     "Pajak PBB",
-		Price:    40000,
+		Price:    models.NewMoney(40000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "PLN",
 		Name:     "Listrik",
-		Price:    10000,
+		Price:    models.NewMoney(10000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "PDAM",
 		Name:     "PDAM Berlangganan",
-		Price:    40000,
+		Price:    models.NewMoney(40000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "PULSA",
 		Name:     "Pulsa",
-		Price:    40000,
+		Price:    models.NewMoney(40000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "PGN",
 		Name:     "PGN Berlangganan",
-		Price:    50000,
+		Price:    models.NewMoney(50000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "MUSIK",
 		Name:     "Musik Berlangganan",
-		Price:    50000,
+		Price:    models.NewMoney(50000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "TV",
 		Name:     "TV Berlangganan",
-		Price:    50000,
+		Price:    models.NewMoney(50000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "PAKET_DATA",
 		Name:     "Paket data",
-		Price:    50000,
+		Price:    models.NewMoney(50000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "VOUCHER_GAME",
 		Name:     "Voucher Game",
-		Price:    100000,
+		Price:    models.NewMoney(100000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "VOUCHER_MAKANAN",
 		Name:     "Voucher Makanan",
-		Price:    100000,
+		Price:    models.NewMoney(100000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 	{
 		Code:     "ZAKAT",
 		Name:     "Zakat",
-		Price:    300000,
+		Price:    models.NewMoney(300000),
+		Currency: models.IDR,
 		Merchant: "admin",
 	},
 }
 
+// categories are seeded parents first. Products lists the seeded products
+// filed directly under each category.
+var categories = []struct {
+	Name     string
+	Slug     string
+	Parent   string
+	Products []string
+}{
+	{Name: "Tagihan", Slug: "tagihan"},
+	{Name: "Utilitas", Slug: "utilitas", Parent: "tagihan", Products: []string{"PLN", "PDAM", "PGN"}},
+	{Name: "Pajak", Slug: "pajak", Parent: "tagihan", Products: []string{"PAJAK"}},
+	{Name: "Langganan", Slug: "langganan", Products: []string{"TV", "MUSIK"}},
+	{Name: "Produk Digital", Slug: "produk-digital"},
+	{Name: "Pulsa & Data", Slug: "pulsa-data", Parent: "produk-digital", Products: []string{"PULSA", "PAKET_DATA"}},
+	{Name: "Voucher", Slug: "voucher", Parent: "produk-digital", Products: []string{"VOUCHER_GAME", "VOUCHER_MAKANAN"}},
+	{Name: "Donasi", Slug: "donasi", Products: []string{"ZAKAT"}},
+}
+
+// variants are seeded for products sold in denominations.
+var variants = map[string][]models.ProductVariant{
+	"PULSA": {
+		{SKU: "PULSA-TSEL-25K", Name: "Telkomsel 25.000", Price: models.NewMoney(26000), Options: models.Options{"operator": "Telkomsel", "nominal": "25k"}},
+		{SKU: "PULSA-TSEL-50K", Name: "Telkomsel 50.000", Price: models.NewMoney(50500), Options: models.Options{"operator": "Telkomsel", "nominal": "50k"}},
+		{SKU: "PULSA-XL-25K", Name: "XL 25.000", Price: models.NewMoney(25500), Options: models.Options{"operator": "XL", "nominal": "25k"}},
+		{SKU: "PULSA-XL-50K", Name: "XL 50.000", Price: models.NewMoney(50000), Options: models.Options{"operator": "XL", "nominal": "50k"}},
+	},
+	"VOUCHER_GAME": {
+		{SKU: "VOUCHER_GAME-50K", Name: "Voucher 50.000", Price: models.NewMoney(50000), Options: models.Options{"nominal": "50k"}},
+		{SKU: "VOUCHER_GAME-100K", Name: "Voucher 100.000", Price: models.NewMoney(100000), Options: models.Options{"nominal": "100k"}},
+	},
+}
+
 func Load(db *gorm.DB) {
 	hash, err := util.HashedPassword("qwerty")
 	if err != nil {
@@ -85,13 +129,99 @@ func Load(db *gorm.DB) {
 	user := models.User{
 		Username: "admin",
 		Password: hash,
-		Role:     models.Role("MERCHANT"),
+		Role:     models.Admin,
 		Account: &models.Account{
-			Owner:   "admin",
-			Balance: 0,
+			Owner:    "admin",
+			Balance:  0,
+			Currency: models.IDR,
 		},
 	}
 
 	db.Create(&user)
+	promoteAdmin(db)
 	db.Create(&products)
+	loadCategories(db)
+	loadVariants(db)
+	loadBillers(db)
+	loadSubscribable(db)
+}
+
+// promoteAdmin makes the seeded "admin" an ADMIN. It was seeded as a
+// MERCHANT before that role existed, and still sells the seeded products.
+func promoteAdmin(db *gorm.DB) {
+	if err := db.Model(&models.User{}).Where("username = ? AND role = ?", "admin", models.Merchant).Update("role", models.Admin).Error; err != nil {
+		log.Fatal(err)
+	}
+}
+
+// subscribable are the seeded products sold as subscriptions.
+var subscribable = []string{"PDAM", "PGN", "TV", "MUSIK"}
+
+func loadSubscribable(db *gorm.DB) {
+	if err := db.Model(&models.Product{}).Where("code IN ? AND NOT subscribable", subscribable).Update("subscribable", true).Error; err != nil {
+		log.Fatal(err)
+	}
+}
+
+// billers maps the seeded bill-payment products to their biller adapter.
+var billers = map[string][]string{
+	"mock": {"PAJAK", "PLN", "PDAM", "PGN"},
+}
+
+// loadBillers sets the biller of seeded bill products that have none yet.
+func loadBillers(db *gorm.DB) {
+	for name, codes := range billers {
+		if err := db.Model(&models.Product{}).Where("code IN ? AND biller IS NULL", codes).Update("biller", name).Error; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// loadVariants seeds the variants of seeded products, skipping SKUs that
+// already exist.
+func loadVariants(db *gorm.DB) {
+	for code, productVariants := range variants {
+		var product models.Product
+		if err := db.Where(&models.Product{Code: code}).First(&product).Error; err != nil {
+			continue
+		}
+		for _, v := range productVariants {
+			v.ProductID = product.ID
+			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&v).Error; err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// loadCategories seeds the category tree once. Categories that already
+// exist are left as they are, so edits made through the API survive restarts.
+func loadCategories(db *gorm.DB) {
+	ids := make(map[string]uint, len(categories))
+	for _, c := range categories {
+		category := models.Category{Name: c.Name, Slug: c.Slug}
+		if c.Parent != "" {
+			parentID := ids[c.Parent]
+			category.ParentID = &parentID
+		}
+
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&category)
+		if res.Error != nil {
+			log.Fatal(res.Error)
+		}
+		if res.RowsAffected == 0 {
+			if err := db.Where(&models.Category{Slug: c.Slug}).First(&category).Error; err != nil {
+				log.Fatal(err)
+			}
+			ids[c.Slug] = category.ID
+			continue
+		}
+		ids[c.Slug] = category.ID
+
+		if len(c.Products) > 0 {
+			if err := db.Exec("INSERT INTO product_categories (product_id, category_id) SELECT id, ? FROM products WHERE code IN ? ON CONFLICT DO NOTHING", category.ID, c.Products).Error; err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 }
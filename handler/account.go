@@ -2,20 +2,20 @@ package handler
 
 import (
 	"errors"
-	"fmt"
-	"time"
+	"sort"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/ilhamosaurus/fiber-commerce/database"
 	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type AccountData struct {
-	ID      uint    `json:"id"`
-	Owner   string  `json:"owner"`
-	Balance float64 `json:"balance"`
+	ID       uint            `json:"id"`
+	Owner    string          `json:"owner"`
+	Balance  models.Money    `json:"balance"`
+	Currency models.Currency `json:"currency"`
 }
 
 type TransactionUtil struct {
@@ -23,8 +23,8 @@ type TransactionUtil struct {
 	Account *AccountData `json:"account"`
 }
 
-func GetAccountByUsername(username string) (*AccountData, error) {
-	db := database.DB
+func (d *Deps) GetAccountByUsername(username string) (*AccountData, error) {
+	db := d.DB
 
 	var account models.Account
 	if err := db.Where(&models.Account{Owner: username}).First(&account).Error; err != nil {
@@ -35,34 +35,59 @@ func GetAccountByUsername(username string) (*AccountData, error) {
 	}
 
 	accountData := AccountData{
-		ID:      account.ID,
-		Owner:   account.Owner,
-		Balance: account.Balance,
+		ID:       account.ID,
+		Owner:    account.Owner,
+		Balance:  account.Balance,
+		Currency: account.Currency,
 	}
 
 	return &accountData, nil
 }
 
-func GetInvNumber(username string) (*TransactionUtil, error) {
-	db := database.DB
+// lockAccounts loads the accounts owned by the given usernames with a
+// SELECT ... FOR UPDATE lock held until tx ends. Rows are locked in owner
+// order so concurrent callers cannot deadlock on each other. Owners without
+// an account are missing from the returned map.
+func lockAccounts(tx *gorm.DB, usernames ...string) (map[string]*models.Account, error) {
+	owners := make([]string, 0, len(usernames))
+	seen := make(map[string]bool)
+	for _, u := range usernames {
+		if !seen[u] {
+			seen[u] = true
+			owners = append(owners, u)
+		}
+	}
+	sort.Strings(owners)
+
+	var accounts []models.Account
+	if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where("owner IN ?", owners).Order("owner").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+
+	locked := make(map[string]*models.Account, len(accounts))
+	for i := range accounts {
+		locked[accounts[i].Owner] = &accounts[i]
+	}
+
+	return locked, nil
+}
+
+func (d *Deps) GetInvNumber(username string) (*TransactionUtil, error) {
+	db := d.DB
 
-	account, err := GetAccountByUsername(username)
+	account, err := d.GetAccountByUsername(username)
 	if err != nil {
 		return nil, err
 	}
 	if account == nil {
 		return nil, nil
 	}
-	var count int64
-	today := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.Now().Location())
-	if err := db.Model(&models.Order{}).Where("account_id = ? AND created_at >= ?", account.ID, today).Count(&count).Error; err != nil {
+
+	invNumber, err := d.Invoices.Next(db, username)
+	if err != nil {
 		return nil, err
 	}
-	if count == 0 {
-		count = 0
-	}
-
-	invNumber := fmt.Sprintf("INV%s-%04d", today.Format("02012006"), count+1)
 
 	transactionUtil := TransactionUtil{
 		Invoice: invNumber,
@@ -82,12 +107,14 @@ func GetInvNumber(username string) (*TransactionUtil, error) {
 // @Failure 404 {object} string "Account not found"
 // @Failure 500 {object} string "Failed to get balance"
 // @Router /api/transaction/balance [get]
-func GetBalance(c *fiber.Ctx) error {
-	user := c.Locals("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
+func (h *Accounts) GetBalance(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
 
-	account, err := GetAccountByUsername(username)
+	account, err := h.GetAccountByUsername(username)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get balance", "data": err})
 	}
@@ -97,9 +124,10 @@ func GetBalance(c *fiber.Ctx) error {
 	}
 
 	type BalanceResponse struct {
-		Owner   string  `json:"owner"`
-		Balance float64 `json:"balance"`
+		Owner    string          `json:"owner"`
+		Balance  models.Money    `json:"balance"`
+		Currency models.Currency `json:"currency"`
 	}
 
-	return c.Status(200).JSON(BalanceResponse{account.Owner, account.Balance})
+	return c.Status(200).JSON(BalanceResponse{account.Owner, account.Balance, account.Currency})
 }
@@ -0,0 +1,478 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errSelfAction   = errors.New("staff cannot change their own account")
+)
+
+type UserData struct {
+	ID            uint            `json:"id"`
+	Username      string          `json:"username"`
+	Role          models.Role     `json:"role"`
+	Email         *string         `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+	Phone         *string         `json:"phone"`
+	Balance       *models.Money   `json:"balance"`
+	Currency      models.Currency `json:"currency"`
+	SuspendedAt   *time.Time      `json:"suspended_at"`
+	SuspendReason *string         `json:"suspend_reason"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func userData(user models.User) UserData {
+	data := UserData{
+		ID:            user.ID,
+		Username:      user.Username,
+		Role:          user.Role,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		Phone:         user.Phone,
+		SuspendedAt:   user.SuspendedAt,
+		SuspendReason: user.SuspendReason,
+		CreatedAt:     user.CreatedAt,
+	}
+	if user.Account != nil {
+		data.Balance, data.Currency = &user.Account.Balance, user.Account.Currency
+	}
+	return data
+}
+
+func adminError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	case errors.Is(err, errSelfAction):
+		return c.Status(400).JSON(fiber.Map{"error": "You cannot change your own account"})
+	case errors.Is(err, errAccountNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	case errors.Is(err, errInsufficientBalance):
+		return c.Status(400).JSON(fiber.Map{"error": "Adjustment would make the balance negative"})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update user", "data": err})
+	}
+}
+
+// updateUser locks the user named in the path and applies change, which
+// staff may not do to themselves. The user's tokens are revoked so the
+// change applies at once.
+func (h *Admin) updateUser(c *fiber.Ctx, change func(tx *gorm.DB, user *models.User) error) (*models.User, error) {
+	staff, err := util.CurrentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	db := h.DB
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where(&models.User{Username: c.Params("username")}).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errUserNotFound
+			}
+			return err
+		}
+		if user.Username == staff.Username {
+			return errSelfAction
+		}
+		if err := change(tx, &user); err != nil {
+			return err
+		}
+		if err := h.revokeRefreshTokens(tx, "owner = ?", user.Username); err != nil {
+			return err
+		}
+		return tx.Preload("Account").First(&user, user.ID).Error
+	})
+	return &user, err
+}
+
+// @Summary List users
+// @Tags Admin
+// @Description List users with their role, balance and suspension. Requires user:read.
+// @Security Bearer
+// @Produce json
+// @Param q query string false "Username or email contains"
+// @Param role query string false "Role" Enums(CLIENT, MERCHANT, ADMIN)
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Param offset query int false "Users to skip"
+// @Success 200 {array} handler.UserData
+// @Failure 400 {object} string "Invalid query"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to get users"
+// @Router /api/admin/users [get]
+func (h *Admin) GetUsers(c *fiber.Ctx) error {
+	db := h.DB
+
+	query := models.UserQuery{}
+	if err := c.QueryParser(&query); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid query"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(query); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+	if query.Limit == 0 {
+		query.Limit = 20
+	}
+
+	tx := db.Preload("Account").Order("id").Limit(query.Limit).Offset(query.Offset)
+	if query.Q != "" {
+		pattern := "%" + escapeLike(query.Q) + "%"
+		tx = tx.Where("username ILIKE ? OR email ILIKE ?", pattern, pattern)
+	}
+	if query.Role != "" {
+		tx = tx.Where("role = ?", query.Role)
+	}
+	var users []models.User
+	if err := tx.Find(&users).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get users", "data": err})
+	}
+
+	data := make([]UserData, 0, len(users))
+	for _, u := range users {
+		data = append(data, userData(u))
+	}
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Get user
+// @Tags Admin
+// @Description Get a user with their role, balance and suspension. Requires user:read.
+// @Security Bearer
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} handler.UserData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "User not found"
+// @Failure 500 {object} string "Failed to get user"
+// @Router /api/admin/users/{username} [get]
+func (h *Admin) GetUser(c *fiber.Ctx) error {
+	db := h.DB
+
+	var user models.User
+	if err := db.Preload("Account").Where(&models.User{Username: c.Params("username")}).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get user", "data": err})
+	}
+
+	return c.Status(200).JSON(userData(user))
+}
+
+// @Summary Change user role
+// @Tags Admin
+// @Description Change a user's role. The user's tokens are revoked, so the new role applies from their next login. Requires user:role.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param body body models.ChangeRoleValidation true "Role"
+// @Success 200 {object} handler.UserData
+// @Failure 400 {object} string "Invalid fields or own account"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "User not found"
+// @Failure 500 {object} string "Failed to update user"
+// @Router /api/admin/users/{username}/role [put]
+func (h *Admin) ChangeUserRole(c *fiber.Ctx) error {
+	body := &models.ChangeRoleValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	user, err := h.updateUser(c, func(tx *gorm.DB, user *models.User) error {
+		return tx.Model(user).Update("role", body.Role).Error
+	})
+	if err != nil {
+		return adminError(c, err)
+	}
+
+	return c.Status(200).JSON(userData(*user))
+}
+
+// @Summary Suspend user
+// @Tags Admin
+// @Description Suspend a user. They are logged out of every device and cannot log in until unsuspended. Requires user:suspend.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param body body models.SuspendUserValidation true "Reason"
+// @Success 200 {object} handler.UserData
+// @Failure 400 {object} string "Invalid fields or own account"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "User not found"
+// @Failure 500 {object} string "Failed to update user"
+// @Router /api/admin/users/{username}/suspend [post]
+func (h *Admin) SuspendUser(c *fiber.Ctx) error {
+	body := &models.SuspendUserValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	user, err := h.updateUser(c, func(tx *gorm.DB, user *models.User) error {
+		return tx.Model(user).Updates(map[string]interface{}{"suspended_at": h.Now(), "suspend_reason": body.Reason}).Error
+	})
+	if err != nil {
+		return adminError(c, err)
+	}
+
+	return c.Status(200).JSON(userData(*user))
+}
+
+// @Summary Unsuspend user
+// @Tags Admin
+// @Description Lift a user's suspension. Requires user:suspend.
+// @Security Bearer
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} handler.UserData
+// @Failure 400 {object} string "Own account"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "User not found"
+// @Failure 500 {object} string "Failed to update user"
+// @Router /api/admin/users/{username}/unsuspend [post]
+func (h *Admin) UnsuspendUser(c *fiber.Ctx) error {
+	user, err := h.updateUser(c, func(tx *gorm.DB, user *models.User) error {
+		return tx.Model(user).Updates(map[string]interface{}{"suspended_at": nil, "suspend_reason": nil}).Error
+	})
+	if err != nil {
+		return adminError(c, err)
+	}
+
+	return c.Status(200).JSON(userData(*user))
+}
+
+// @Summary Unlock login
+// @Tags Admin
+// @Description Lift a lockout from too many failed logins on a user, and forget the failures. Locks on client addresses expire on their own. Requires user:suspend.
+// @Security Bearer
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} string "User unlocked"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "User not found"
+// @Failure 500 {object} string "Failed to update user"
+// @Router /api/admin/users/{username}/unlock [post]
+func (h *Admin) UnlockUser(c *fiber.Ctx) error {
+	staff, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	user, err := h.getUserByUsername(c.Params("username"))
+	if err != nil {
+		return adminError(c, err)
+	}
+	if user == nil {
+		return adminError(c, errUserNotFound)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("key = ?", userThrottleKey(user.Username)).Delete(&models.LoginThrottle{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.AuditEvent{
+			Action:  models.AuditLoginUnlock,
+			Actor:   &staff.Username,
+			Subject: userThrottleKey(user.Username),
+			IP:      c.IP(),
+		}).Error
+	})
+	if err != nil {
+		return adminError(c, err)
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "User unlocked"})
+}
+
+// @Summary Adjust balance
+// @Tags Admin
+// @Description Correct a user's balance with an ADJUSTMENT order, posted against the ADJUSTMENT system account. A negative amount debits the user but never below zero. Requires account:adjust.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param body body models.AdjustBalanceValidation true "Adjustment"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Success 201 {object} handler.AdjustBalance.AdjustmentResponse
+// @Failure 400 {object} string "Invalid fields or balance would be negative"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Account not found"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 500 {object} string "Failed to adjust balance"
+// @Router /api/admin/accounts/{username}/adjust [post]
+func (h *Admin) AdjustBalance(c *fiber.Ctx) error {
+	type AdjustmentResponse struct {
+		Invoice   string          `json:"invoice"`
+		Owner     string          `json:"owner"`
+		Amount    models.Money    `json:"amount"`
+		Balance   models.Money    `json:"balance"`
+		Currency  models.Currency `json:"currency"`
+		Reason    string          `json:"reason"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	staff, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := c.Params("username")
+	db := h.DB
+
+	body := &models.AdjustBalanceValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var response AdjustmentResponse
+	err = db.Transaction(func(tx *gorm.DB) error {
+		accounts, err := lockAccounts(tx, username)
+		if err != nil {
+			return err
+		}
+		account := accounts[username]
+		if account == nil {
+			return errAccountNotFound
+		}
+
+		amount := body.Amount
+		if amount < 0 {
+			amount = -amount
+			if amount > account.Balance {
+				return errInsufficientBalance
+			}
+		}
+
+		transactionUtil, err := h.GetInvNumber(username)
+		if err != nil {
+			return err
+		}
+		description := fmt.Sprintf("Balance adjustment of %s by %s: %s", body.Amount, staff.Username, body.Reason)
+		adjustment := models.Order{
+			AccountID:   account.ID,
+			Invoice:     transactionUtil.Invoice,
+			Amount:      amount,
+			Currency:    account.Currency,
+			Type:        models.Adjustment,
+			Status:      models.Completed,
+			Description: &description,
+		}
+		if err := tx.Create(&adjustment).Error; err != nil {
+			return err
+		}
+
+		postings := []models.Posting{
+			ledger.DebitSystem(ledger.Adjustment, amount, account.Currency),
+			ledger.CreditAccount(account, amount, &adjustment.ID),
+		}
+		if body.Amount < 0 {
+			postings = []models.Posting{
+				ledger.DebitAccount(account, amount, &adjustment.ID),
+				ledger.CreditSystem(ledger.Adjustment, amount, account.Currency),
+			}
+		}
+		if err := ledger.Post(tx, &models.JournalEntry{
+			Reference:   adjustment.Invoice,
+			Description: &description,
+			Postings:    postings,
+		}); err != nil {
+			return err
+		}
+
+		response = AdjustmentResponse{
+			Invoice:   adjustment.Invoice,
+			Owner:     username,
+			Amount:    body.Amount,
+			Balance:   account.Balance + body.Amount,
+			Currency:  account.Currency,
+			Reason:    body.Reason,
+			CreatedAt: adjustment.CreatedAt,
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errAccountNotFound) || errors.Is(err, errInsufficientBalance) {
+			return adminError(c, err)
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to adjust balance", "data": err})
+	}
+
+	return c.Status(201).JSON(fiber.Map{"data": response})
+}
+
+// @Summary Check ledger
+// @Tags Admin
+// @Description Reconcile every account's cached balance with the sum of its ledger postings and list those that differ. An empty list means the balances are consistent. Requires ledger:check.
+// @Security Bearer
+// @Produce json
+// @Success 200 {object} handler.CheckLedger.LedgerCheckResponse
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to check ledger"
+// @Router /api/admin/ledger/check [get]
+func (h *Admin) CheckLedger(c *fiber.Ctx) error {
+	type LedgerCheckResponse struct {
+		Consistent    bool                 `json:"consistent"`
+		Discrepancies []ledger.Discrepancy `json:"discrepancies"`
+		CheckedAt     time.Time            `json:"checked_at"`
+	}
+
+	discrepancies, err := ledger.Check(h.DB)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check ledger", "data": err})
+	}
+	if discrepancies == nil {
+		discrepancies = make([]ledger.Discrepancy, 0)
+	}
+
+	return c.Status(200).JSON(LedgerCheckResponse{
+		Consistent:    len(discrepancies) == 0,
+		Discrepancies: discrepancies,
+		CheckedAt:     h.Now(),
+	})
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+// apiKeyPrefix starts every key, so leaked keys are easy to spot.
+const apiKeyPrefix = "fck_"
+
+type APIKeyData struct {
+	ID         uint           `json:"id"`
+	Name       string         `json:"name"`
+	Prefix     string         `json:"prefix" example:"fck_Zm9vYmFy"`
+	Scopes     []models.Scope `json:"scopes"`
+	ExpiresAt  *time.Time     `json:"expires_at"`
+	LastUsedAt *time.Time     `json:"last_used_at"`
+	LastUsedIP *string        `json:"last_used_ip"`
+	RevokedAt  *time.Time     `json:"revoked_at"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+func apiKeyData(key models.APIKey) APIKeyData {
+	return APIKeyData{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.ScopeList(),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// @Summary Create API key
+// @Tags API Key
+// @Description Create a key for server-to-server calls, sent as X-API-Key. It acts as the user, limited to its scopes, and is shown only in this response. Requires apikey:manage.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.CreateAPIKeyValidation true "API key"
+// @Success 201 {object} handler.CreateAPIKey.CreateAPIKeyResponse
+// @Failure 400 {object} string "Invalid fields, or scope the role cannot grant"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to create API key"
+// @Router /api/keys [post]
+func (h *Auth) CreateAPIKey(c *fiber.Ctx) error {
+	type CreateAPIKeyResponse struct {
+		APIKeyData
+		Key string `json:"key" example:"fck_Zm9vYmFyYmF6cXV4Zm9vYmFyYmF6cXV4Zm9vYmFy"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.CreateAPIKeyValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(h.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_at must be in the future"})
+	}
+
+	scopes := make([]string, 0, len(body.Scopes))
+	for _, scope := range body.Scopes {
+		if !user.Role.CanGrant(scope) {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Your role cannot grant %s", scope)})
+		}
+		scopes = append(scopes, string(scope))
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create API key", "data": err})
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	apiKey := models.APIKey{
+		Owner:     user.Username,
+		Name:      body.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   util.HashToken(key),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: body.ExpiresAt,
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create API key", "data": err})
+	}
+
+	return c.Status(201).JSON(CreateAPIKeyResponse{APIKeyData: apiKeyData(apiKey), Key: key})
+}
+
+// @Summary List API keys
+// @Tags API Key
+// @Description List the user's API keys, revoked ones included. Requires apikey:manage.
+// @Security Bearer
+// @Produce json
+// @Success 200 {array} handler.APIKeyData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to get API keys"
+// @Router /api/keys [get]
+func (h *Auth) GetAPIKeys(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	var keys []models.APIKey
+	if err := db.Where("owner = ?", user.Username).Order("id").Find(&keys).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get API keys", "data": err})
+	}
+
+	data := make([]APIKeyData, 0, len(keys))
+	for _, k := range keys {
+		data = append(data, apiKeyData(k))
+	}
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Revoke API key
+// @Tags API Key
+// @Description Revoke one of the user's API keys. It stops working at once. Requires apikey:manage.
+// @Security Bearer
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} handler.APIKeyData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "API key not found"
+// @Failure 500 {object} string "Failed to revoke API key"
+// @Router /api/keys/{id} [delete]
+func (h *Auth) RevokeAPIKey(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "API key not found"})
+	}
+
+	var key models.APIKey
+	if err := db.Where("id = ? AND owner = ?", id, user.Username).Limit(1).Find(&key).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke API key", "data": err})
+	}
+	if key.ID == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "API key not found"})
+	}
+	if key.RevokedAt == nil {
+		now := h.Now()
+		if err := db.Model(&key).Update("revoked_at", now).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke API key", "data": err})
+		}
+		key.RevokedAt = &now
+	}
+
+	return c.Status(200).JSON(apiKeyData(key))
+}
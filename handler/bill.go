@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/biller"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errBillProduct     = errors.New("product is a bill")
+	errNotBillProduct  = errors.New("product is not a bill")
+	errInquiryNotFound = errors.New("inquiry not found")
+	errInquiryExpired  = errors.New("inquiry expired")
+	errInquiryPaid     = errors.New("inquiry already paid")
+)
+
+type BillInquiryData struct {
+	Reference      string          `json:"reference"`
+	Code           string          `json:"code"`
+	CustomerNumber string          `json:"customer_number"`
+	CustomerName   string          `json:"customer_name"`
+	Period         string          `json:"period"`
+	Amount         models.Money    `json:"amount"`
+	Currency       models.Currency `json:"currency"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+}
+
+func billError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	case errors.Is(err, errNotBillProduct):
+		return c.Status(400).JSON(fiber.Map{"error": "Product is not a bill"})
+	case errors.Is(err, errInquiryNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Inquiry not found"})
+	case errors.Is(err, errInquiryExpired):
+		return c.Status(409).JSON(fiber.Map{"error": "Inquiry expired, inquire again"})
+	case errors.Is(err, errInquiryPaid):
+		return c.Status(409).JSON(fiber.Map{"error": "Inquiry already paid"})
+	case errors.Is(err, biller.ErrCustomerNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Customer not found"})
+	case errors.Is(err, biller.ErrAlreadyPaid):
+		return c.Status(409).JSON(fiber.Map{"error": "Bill already paid"})
+	case errors.Is(err, biller.ErrAmountMismatch):
+		return c.Status(409).JSON(fiber.Map{"error": "Bill changed since inquiry, inquire again"})
+	case errors.Is(err, biller.ErrUnknownBiller), errors.Is(err, biller.ErrUnavailable):
+		return c.Status(502).JSON(fiber.Map{"error": "Biller unavailable", "data": err.Error()})
+	default:
+		return orderError(c, err)
+	}
+}
+
+// payBill charges buyer for bill inside tx and pays it at the product's
+// biller. reference identifies the payment to the biller, so paying again
+// under the same reference returns the first receipt.
+func (h *Billing) payBill(ctx context.Context, tx *gorm.DB, buyer string, product *ProductData, bill biller.Bill, reference string) (*models.Order, *biller.Receipt, error) {
+	if product.Biller == nil {
+		return nil, nil, errNotBillProduct
+	}
+	b, err := h.Billers.Get(*product.Biller)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := h.placeOrder(tx, buyer, []orderLine{{Product: product, Amount: &bill.Amount, Qty: 1}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receipt, err := b.Pay(ctx, product.Code, bill, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	description := fmt.Sprintf("Bill payment %s for %s (%s)", product.Name, bill.CustomerNumber, bill.CustomerName)
+	order.BillerReference, order.BillerToken, order.Description = &receipt.Reference, receipt.Token, &description
+	if err := tx.Model(order).Select("biller_reference", "biller_token", "description").Updates(order).Error; err != nil {
+		return nil, nil, err
+	}
+	return order, receipt, nil
+}
+
+// @Summary Bill inquiry
+// @Tags Bill
+// @Description Ask the product's biller what a customer owes. The returned reference pays the bill before it expires.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.BillInquiryValidation true "Inquiry"
+// @Success 201 {object} handler.BillInquiryData
+// @Failure 400 {object} string "Invalid fields or product is not a bill"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product or customer not found"
+// @Failure 409 {object} string "Bill already paid"
+// @Failure 502 {object} string "Biller unavailable"
+// @Failure 500 {object} string "Failed to inquire"
+// @Router /api/bill/inquiry [post]
+func (h *Billing) BillInquiry(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.BillInquiryValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	product, err := h.GetProductByCode(body.Code)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to inquire", "data": err})
+	}
+	if product == nil {
+		return billError(c, errProductNotFound)
+	}
+	if product.Biller == nil {
+		return billError(c, errNotBillProduct)
+	}
+
+	b, err := h.Billers.Get(*product.Biller)
+	if err != nil {
+		return billError(c, err)
+	}
+	bill, err := b.Inquire(c.UserContext(), product.Code, body.CustomerNumber)
+	if err != nil {
+		return billError(c, err)
+	}
+
+	inquiry := models.BillInquiry{
+		Reference:      "INQ-" + uuid.NewString(),
+		Owner:          username,
+		ProductCode:    product.Code,
+		Biller:         *product.Biller,
+		CustomerNumber: bill.CustomerNumber,
+		CustomerName:   bill.CustomerName,
+		Amount:         bill.Amount,
+		Currency:       product.Currency,
+		Period:         bill.Period,
+		ExpiresAt:      h.Now().Add(h.Config.Billing.InquiryTTL),
+	}
+	if err := db.Create(&inquiry).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to inquire", "data": err})
+	}
+
+	return c.Status(201).JSON(BillInquiryData{
+		Reference:      inquiry.Reference,
+		Code:           inquiry.ProductCode,
+		CustomerNumber: inquiry.CustomerNumber,
+		CustomerName:   inquiry.CustomerName,
+		Period:         inquiry.Period,
+		Amount:         inquiry.Amount,
+		Currency:       inquiry.Currency,
+		ExpiresAt:      inquiry.ExpiresAt,
+	})
+}
+
+// @Summary Pay bill
+// @Tags Bill
+// @Description Pay an inquiry. The balance is charged and the biller paid in one step, and the biller's reference and token are stored on the order. Users with two-factor authentication send a code in X-2FA-Code from STEP_UP_THRESHOLD.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.PayBillValidation true "Inquiry reference"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Param X-2FA-Code header string false "Two-factor code, for amounts from STEP_UP_THRESHOLD"
+// @Success 201 {object} handler.PayBill.BillPaymentResponse
+// @Failure 400 {object} string "Invalid fields or insufficient balance"
+// @Failure 401 {object} string "Unauthorized, or two-factor code missing or invalid"
+// @Failure 404 {object} string "Inquiry not found"
+// @Failure 409 {object} string "Inquiry expired or already paid"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 429 {object} string "Too many invalid two-factor codes"
+// @Failure 502 {object} string "Biller unavailable"
+// @Failure 500 {object} string "Failed to purchase"
+// @Router /api/bill/pay [post]
+func (h *Billing) PayBill(c *fiber.Ctx) error {
+	type BillPaymentResponse struct {
+		Invoice         string             `json:"invoice"`
+		Code            string             `json:"code"`
+		CustomerNumber  string             `json:"customer_number"`
+		CustomerName    string             `json:"customer_name"`
+		Amount          models.Money       `json:"amount"`
+		Currency        models.Currency    `json:"currency"`
+		Status          models.OrderStatus `json:"status"`
+		BillerReference string             `json:"biller_reference"`
+		Token           *string            `json:"token"`
+		CreatedAt       time.Time          `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.PayBillValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	// the amount is fixed at inquiry, so it is read ahead of the locked
+	// read below to decide whether the payment needs a second factor
+	var quoted models.BillInquiry
+	if err := db.Where(&models.BillInquiry{Reference: body.Reference, Owner: username}).First(&quoted).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return billError(c, errInquiryNotFound)
+		}
+		return billError(c, err)
+	}
+	if err := h.requireStepUp(c, username, quoted.Amount); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	var inquiry models.BillInquiry
+	var order *models.Order
+	var receipt *biller.Receipt
+	// the biller is paid inside the transaction, so a biller failure rolls
+	// the charge back and a retry pays under the same inquiry reference
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where(&models.BillInquiry{Reference: body.Reference, Owner: username}).
+			First(&inquiry).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInquiryNotFound
+			}
+			return err
+		}
+		if inquiry.OrderID != nil {
+			return errInquiryPaid
+		}
+		if h.Now().After(inquiry.ExpiresAt) {
+			return errInquiryExpired
+		}
+
+		product, err := h.GetProductByCode(inquiry.ProductCode)
+		if err != nil {
+			return err
+		}
+		if product == nil {
+			return errProductNotFound
+		}
+
+		order, receipt, err = h.payBill(c.UserContext(), tx, username, product, biller.Bill{
+			CustomerNumber: inquiry.CustomerNumber,
+			CustomerName:   inquiry.CustomerName,
+			Amount:         inquiry.Amount,
+			Period:         inquiry.Period,
+		}, inquiry.Reference)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&inquiry).Update("order_id", order.ID).Error
+	})
+	if err != nil {
+		return billError(c, err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{"data": BillPaymentResponse{
+		Invoice:         order.Invoice,
+		Code:            inquiry.ProductCode,
+		CustomerNumber:  inquiry.CustomerNumber,
+		CustomerName:    inquiry.CustomerName,
+		Amount:          order.Amount,
+		Currency:        order.Currency,
+		Status:          order.Status,
+		BillerReference: receipt.Reference,
+		Token:           receipt.Token,
+		CreatedAt:       order.CreatedAt,
+	}})
+}
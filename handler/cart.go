@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CartItemData struct {
+	Code     string          `json:"code"`
+	SKU      *string         `json:"sku"`
+	Name     string          `json:"name"`
+	Merchant string          `json:"merchant"`
+	Price    models.Money    `json:"price"`
+	Currency models.Currency `json:"currency"`
+	Qty      int             `json:"qty"`
+	Subtotal models.Money    `json:"subtotal"`
+}
+
+type CartData struct {
+	Items []CartItemData `json:"items"`
+	Total models.Money   `json:"total"`
+}
+
+var (
+	errProductUnavailable = errors.New("product unavailable")
+	errNotInCart          = errors.New("product not in cart")
+)
+
+func getOrCreateCart(db *gorm.DB, username string) (*models.Cart, error) {
+	cart := models.Cart{Owner: username}
+	if err := db.Where(&models.Cart{Owner: username}).FirstOrCreate(&cart).Error; err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// cartLines prices the items of cart. Items whose product or variant was
+// deleted are reported with errProductUnavailable unless skipMissing is set.
+func (h *Orders) cartLines(db *gorm.DB, cart *models.Cart, skipMissing bool) ([]orderLine, error) {
+	var items []models.CartItem
+	if err := db.Where("cart_id = ?", cart.ID).Order("created_at").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	lines := make([]orderLine, 0, len(items))
+	for _, item := range items {
+		line, err := h.resolveLine(item.ProductCode, item.VariantSKU, item.Qty)
+		if errors.Is(err, errProductNotFound) || errors.Is(err, errVariantNotFound) || errors.Is(err, errVariantRequired) {
+			if skipMissing {
+				continue
+			}
+			return nil, fmt.Errorf("%w: %s", errProductUnavailable, stockKey{Code: item.ProductCode, SKU: item.VariantSKU})
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, *line)
+	}
+
+	return lines, nil
+}
+
+// cartItemByCode matches the cart item of a variant SKU, or of a product
+// code without variant.
+func cartItemByCode(code string) clause.Expr {
+	return gorm.Expr("(variant_sku = ? OR (variant_sku = '' AND product_code = ?))", code, code)
+}
+
+func cartData(lines []orderLine) (CartData, error) {
+	data := CartData{Items: make([]CartItemData, len(lines))}
+	for i, line := range lines {
+		subtotal, err := line.subtotal()
+		if err != nil {
+			return CartData{}, err
+		}
+		data.Items[i] = CartItemData{
+			Code:     line.Product.Code,
+			SKU:      line.sku(),
+			Name:     line.name(),
+			Merchant: line.Product.Merchant,
+			Price:    line.unitPrice(),
+			Currency: line.Product.Currency,
+			Qty:      line.Qty,
+			Subtotal: subtotal,
+		}
+		if data.Total, err = data.Total.Add(subtotal); err != nil {
+			return CartData{}, err
+		}
+	}
+	return data, nil
+}
+
+// @Summary Get cart
+// @Tags Cart
+// @Description Get user's cart with current prices
+// @Security Bearer
+// @Produce json
+// @Success 200 {object} handler.CartData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to get cart"
+// @Router /api/cart [get]
+func (h *Orders) GetCart(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	cart, err := getOrCreateCart(db, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get cart", "data": err})
+	}
+
+	lines, err := h.cartLines(db, cart, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get cart", "data": err})
+	}
+	data, err := cartData(lines)
+	if err != nil {
+		return orderError(c, err)
+	}
+
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Add product to cart
+// @Tags Cart
+// @Description Add a product, or a variant by SKU, to user's cart, adding to the quantity if it is already there
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.AddCartItemValidation true "Cart item"
+// @Success 200 {object} handler.CartData
+// @Failure 400 {object} string "Invalid fields, product is sold by variant, or amount too large"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product or variant not found"
+// @Failure 500 {object} string "Failed to update cart"
+// @Router /api/cart [post]
+func (h *Orders) AddCartItem(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.AddCartItemValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	line, err := h.resolveLine(body.Code, body.SKU, body.Qty)
+	if err != nil {
+		return orderError(c, err)
+	}
+
+	cart, err := getOrCreateCart(db, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+
+	item := models.CartItem{CartID: cart.ID, ProductCode: line.Product.Code, Qty: body.Qty}
+	if line.Variant != nil {
+		item.VariantSKU = line.Variant.SKU
+	}
+	var data CartData
+	// priced in the same transaction, so a quantity the cart cannot total
+	// is not kept
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "cart_id"}, {Name: "product_code"}, {Name: "variant_sku"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"qty": gorm.Expr("cart_items.qty + ?", body.Qty), "updated_at": h.Now()}),
+		}).Create(&item).Error; err != nil {
+			return err
+		}
+
+		lines, err := h.cartLines(tx, cart, true)
+		if err != nil {
+			return err
+		}
+		data, err = cartData(lines)
+		return err
+	})
+	if errors.Is(err, models.ErrMoneyOverflow) {
+		return orderError(c, err)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Update cart item
+// @Tags Cart
+// @Description Set the quantity of a product in user's cart
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param code path string true "Product code, or variant SKU"
+// @Param body body models.UpdateCartItemValidation true "Cart item"
+// @Success 200 {object} handler.CartData
+// @Failure 400 {object} string "Invalid fields, or amount too large"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product not in cart"
+// @Failure 500 {object} string "Failed to update cart"
+// @Router /api/cart/{code} [put]
+func (h *Orders) UpdateCartItem(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	code := strings.ToUpper(c.Params("code"))
+	db := h.DB
+
+	body := &models.UpdateCartItemValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	cart, err := getOrCreateCart(db, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+
+	var data CartData
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.CartItem{}).Where("cart_id = ?", cart.ID).Where(cartItemByCode(code)).Update("qty", body.Qty)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errNotInCart
+		}
+
+		lines, err := h.cartLines(tx, cart, true)
+		if err != nil {
+			return err
+		}
+		data, err = cartData(lines)
+		return err
+	})
+	if errors.Is(err, errNotInCart) {
+		return c.Status(404).JSON(fiber.Map{"error": "Product not in cart"})
+	}
+	if errors.Is(err, models.ErrMoneyOverflow) {
+		return orderError(c, err)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Remove cart item
+// @Tags Cart
+// @Description Remove a product from user's cart
+// @Security Bearer
+// @Produce json
+// @Param code path string true "Product code, or variant SKU"
+// @Success 200 {object} handler.CartData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product not in cart"
+// @Failure 500 {object} string "Failed to update cart"
+// @Router /api/cart/{code} [delete]
+func (h *Orders) RemoveCartItem(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	code := strings.ToUpper(c.Params("code"))
+	db := h.DB
+
+	cart, err := getOrCreateCart(db, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+
+	// hard delete so the product can be added again under the unique index
+	res := db.Unscoped().Where("cart_id = ?", cart.ID).Where(cartItemByCode(code)).Delete(&models.CartItem{})
+	if res.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": res.Error})
+	}
+	if res.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Product not in cart"})
+	}
+
+	lines, err := h.cartLines(db, cart, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update cart", "data": err})
+	}
+	data, err := cartData(lines)
+	if err != nil {
+		return orderError(c, err)
+	}
+
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Checkout cart
+// @Tags Cart
+// @Description Pay for every product in user's cart as one order, splitting the revenue across merchants. Users with two-factor authentication send a code in X-2FA-Code from STEP_UP_THRESHOLD.
+// @Security Bearer
+// @Produce json
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Param X-2FA-Code header string false "Two-factor code, for amounts from STEP_UP_THRESHOLD"
+// @Success 201 {object} handler.Checkout.CheckoutResponse
+// @Failure 400 {object} string "Cart is empty or insufficient balance"
+// @Failure 401 {object} string "Unauthorized, or two-factor code missing or invalid"
+// @Failure 404 {object} string "Account not found"
+// @Failure 409 {object} string "Product in cart is no longer available or out of stock"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 429 {object} string "Too many invalid two-factor codes"
+// @Failure 500 {object} string "Failed to checkout"
+// @Router /api/cart/checkout [post]
+func (h *Orders) Checkout(c *fiber.Ctx) error {
+	type CheckoutResponse struct {
+		Invoice   string             `json:"invoice"`
+		Buyer     *string            `json:"buyer"`
+		Amount    models.Money       `json:"amount"`
+		Currency  models.Currency    `json:"currency"`
+		Type      models.Type        `json:"type"`
+		Status    models.OrderStatus `json:"status"`
+		Items     []OrderItemData    `json:"items"`
+		CreatedAt time.Time          `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	cart, err := getOrCreateCart(db, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to checkout", "data": err})
+	}
+
+	// priced again under the cart lock below, this is only to decide whether
+	// the checkout needs a second factor
+	lines, err := h.cartLines(db, cart, true)
+	if err != nil {
+		return orderError(c, err)
+	}
+	total, err := linesTotal(lines)
+	if err != nil {
+		return orderError(c, err)
+	}
+	if err := h.requireStepUp(c, username, total); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	var order *models.Order
+	var stepUpErr error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// lock the cart so a concurrent checkout cannot pay for it twice
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(cart, cart.ID).Error; err != nil {
+			return err
+		}
+
+		lines, err := h.cartLines(tx, cart, false)
+		if err != nil {
+			return err
+		}
+		// an item added since the first pricing can take the cart over the
+		// threshold, and then the second factor is asked for after all. A
+		// code already checked above is not checked twice.
+		if total < h.Config.Limits.StepUpThreshold {
+			locked, err := linesTotal(lines)
+			if err != nil {
+				return err
+			}
+			if stepUpErr = h.requireStepUp(c, username, locked); stepUpErr != nil {
+				return stepUpErr
+			}
+		}
+
+		order, err = h.placeOrder(tx, username, lines)
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error
+	})
+	if stepUpErr != nil {
+		return twoFactorError(c, stepUpErr)
+	}
+	if errors.Is(err, errEmptyOrder) {
+		return c.Status(400).JSON(fiber.Map{"error": "Cart is empty"})
+	}
+	if errors.Is(err, errProductUnavailable) {
+		return c.Status(409).JSON(fiber.Map{"error": "Product in cart is no longer available", "data": err.Error()})
+	}
+	if err != nil {
+		return orderError(c, err)
+	}
+
+	response := CheckoutResponse{
+		Invoice:   order.Invoice,
+		Buyer:     order.Buyer,
+		Amount:    order.Amount,
+		Currency:  order.Currency,
+		Type:      order.Type,
+		Status:    order.Status,
+		Items:     orderItemData(order.Items),
+		CreatedAt: order.CreatedAt,
+	}
+
+	return c.Status(201).JSON(fiber.Map{"data": response})
+}
@@ -0,0 +1,449 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+)
+
+var (
+	errCategoryNotFound    = errors.New("category not found")
+	errParentNotFound      = errors.New("parent category not found")
+	errCategoryCycle       = errors.New("category cannot be moved under itself")
+	errCategoryHasChildren = errors.New("category has subcategories")
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+type CategoryData struct {
+	Name     string          `json:"name"`
+	Slug     string          `json:"slug"`
+	Parent   *string         `json:"parent"`
+	Children []*CategoryData `json:"children"`
+}
+
+// slugify turns a category name into a slug, "Produk Digital" into
+// "produk-digital".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+func categoryValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterValidation("slug", func(fl validator.FieldLevel) bool {
+		return slugPattern.MatchString(fl.Field().String())
+	})
+	return validate
+}
+
+func getCategoryBySlug(db *gorm.DB, slug string) (*models.Category, error) {
+	var category models.Category
+	if err := db.Where(&models.Category{Slug: slug}).First(&category).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errCategoryNotFound
+		}
+		return nil, err
+	}
+	return &category, nil
+}
+
+// categorySubtree selects the ids of the category with slug and all of its
+// descendants, for use as a subquery.
+func categorySubtree(db *gorm.DB, slug string) *gorm.DB {
+	return db.Raw(`WITH RECURSIVE tree AS (
+		SELECT id FROM categories WHERE slug = ?
+		UNION ALL
+		SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+	) SELECT id FROM tree`, slug)
+}
+
+// categoryTree nests categories under their parents. Categories whose parent
+// is not in the list become roots.
+func categoryTree(categories []models.Category) []*CategoryData {
+	byID := make(map[uint]*CategoryData, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = &CategoryData{Name: c.Name, Slug: c.Slug, Children: []*CategoryData{}}
+	}
+
+	roots := make([]*CategoryData, 0)
+	for _, c := range categories {
+		node := byID[c.ID]
+		if c.ParentID == nil || byID[*c.ParentID] == nil {
+			roots = append(roots, node)
+			continue
+		}
+		parent := byID[*c.ParentID]
+		node.Parent = &parent.Slug
+		parent.Children = append(parent.Children, node)
+	}
+	return roots
+}
+
+// resolveParent looks up the parent slug of a create or update. A nil or
+// empty slug is the top level.
+func resolveParent(db *gorm.DB, slug *string) (*uint, error) {
+	if slug == nil || *slug == "" {
+		return nil, nil
+	}
+	parent, err := getCategoryBySlug(db, *slug)
+	if errors.Is(err, errCategoryNotFound) {
+		return nil, errParentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &parent.ID, nil
+}
+
+func categoryError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+	case errors.Is(err, errParentNotFound):
+		return c.Status(400).JSON(fiber.Map{"error": "Parent category not found"})
+	case errors.Is(err, errCategoryCycle):
+		return c.Status(400).JSON(fiber.Map{"error": "Category cannot be moved under itself"})
+	case errors.Is(err, errCategoryHasChildren):
+		return c.Status(409).JSON(fiber.Map{"error": "Category has subcategories"})
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return c.Status(409).JSON(fiber.Map{"error": "Category's slug already exists"})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save category", "data": err})
+	}
+}
+
+// @Summary Get categories
+// @Description Get the category tree
+// @Tags Categories
+// @Produce json
+// @Success 200 {array} handler.CategoryData "OK"
+// @Failure 500 {object} string "Failed to get categories"
+// @Router /api/category [get]
+func (h *Catalog) GetCategories(c *fiber.Ctx) error {
+	db := h.DB
+
+	var categories []models.Category
+	if err := db.Order("name").Find(&categories).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get categories", "data": err})
+	}
+
+	return c.Status(200).JSON(categoryTree(categories))
+}
+
+// @Summary Get category
+// @Description Get a category with its subcategories
+// @Tags Categories
+// @Produce json
+// @Param slug path string true "Category slug"
+// @Success 200 {object} handler.CategoryData "OK"
+// @Failure 404 {object} string "Category not found"
+// @Failure 500 {object} string "Failed to get category"
+// @Router /api/category/{slug} [get]
+func (h *Catalog) GetCategory(c *fiber.Ctx) error {
+	db := h.DB
+
+	category, err := getCategoryBySlug(db, c.Params("slug"))
+	if errors.Is(err, errCategoryNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get category", "data": err})
+	}
+
+	var subtree []models.Category
+	if err := db.Where("id IN (?)", categorySubtree(db, category.Slug)).Order("name").Find(&subtree).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get category", "data": err})
+	}
+
+	var root *CategoryData
+	for _, node := range categoryTree(subtree) {
+		if node.Slug == category.Slug {
+			root = node
+		}
+	}
+	if category.ParentID != nil {
+		var parent models.Category
+		if err := db.First(&parent, *category.ParentID).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get category", "data": err})
+		}
+		root.Parent = &parent.Slug
+	}
+
+	return c.Status(200).JSON(root)
+}
+
+// @Summary Get category products
+// @Description Get the products of a category and all of its subcategories. Takes the same query parameters as the product list.
+// @Tags Categories
+// @Produce json
+// @Param slug path string true "Category slug"
+// @Param q query string false "Search product name and code"
+// @Param merchant query string false "Merchant username"
+// @Param min_price query string false "Minimum price"
+// @Param max_price query string false "Maximum price"
+// @Param sort query string false "Sort by" Enums(price, name, created_at) default(created_at)
+// @Param order query string false "Sort order" Enums(asc, desc) default(desc)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Success 200 {object} handler.ProductPage "OK"
+// @Failure 400 {object} string "Invalid query"
+// @Failure 404 {object} string "Category not found"
+// @Failure 500 {object} string "Failed to get products"
+// @Router /api/category/{slug}/products [get]
+func (h *Catalog) GetCategoryProducts(c *fiber.Ctx) error {
+	db := h.DB
+
+	if _, err := getCategoryBySlug(db, c.Params("slug")); err != nil {
+		if errors.Is(err, errCategoryNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get products", "data": err})
+	}
+
+	return h.listProducts(c, c.Params("slug"))
+}
+
+// @Summary Create category
+// @Description Create a category, optionally under a parent category. Requires category:write.
+// @Tags Categories
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.CreateCategoryValidation true "Category"
+// @Success 201 {object} handler.CategoryData "Category created"
+// @Failure 400 {object} string "Invalid fields"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 409 {object} string "Category's slug already exists"
+// @Failure 500 {object} string "Failed to save category"
+// @Router /api/category [post]
+func (h *Catalog) CreateCategory(c *fiber.Ctx) error {
+	db := h.DB
+
+	body := &models.CreateCategoryValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+	if body.Slug == "" {
+		body.Slug = slugify(body.Name)
+	}
+
+	if err := categoryValidator().Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	parentID, err := resolveParent(db, body.Parent)
+	if err != nil {
+		return categoryError(c, err)
+	}
+
+	category := models.Category{Name: body.Name, Slug: body.Slug, ParentID: parentID}
+	if err := db.Create(&category).Error; err != nil {
+		return categoryError(c, err)
+	}
+
+	response := CategoryData{Name: category.Name, Slug: category.Slug, Children: []*CategoryData{}}
+	if parentID != nil {
+		response.Parent = body.Parent
+	}
+
+	return c.Status(201).JSON(response)
+}
+
+// @Summary Update category
+// @Description Rename a category or move it under another parent. Requires category:write.
+// @Tags Categories
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param slug path string true "Category slug"
+// @Param body body models.UpdateCategoryValidation true "Category"
+// @Success 200 {object} handler.CategoryData "Category updated"
+// @Failure 400 {object} string "Invalid fields"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Category not found"
+// @Failure 409 {object} string "Category's slug already exists"
+// @Failure 500 {object} string "Failed to save category"
+// @Router /api/category/{slug} [put]
+func (h *Catalog) UpdateCategory(c *fiber.Ctx) error {
+	db := h.DB
+
+	body := &models.UpdateCategoryValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	if err := categoryValidator().Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var category *models.Category
+	err := db.Transaction(func(tx *gorm.DB) error {
+		found, err := getCategoryBySlug(tx, c.Params("slug"))
+		if err != nil {
+			return err
+		}
+		category = found
+
+		parentID, err := resolveParent(tx, body.Parent)
+		if err != nil {
+			return err
+		}
+		if parentID != nil {
+			var subtree []uint
+			if err := categorySubtree(tx, category.Slug).Scan(&subtree).Error; err != nil {
+				return err
+			}
+			if slices.Contains(subtree, *parentID) {
+				return errCategoryCycle
+			}
+		}
+
+		category.Name, category.Slug, category.ParentID = body.Name, body.Slug, parentID
+		return tx.Select("name", "slug", "parent_id").Save(category).Error
+	})
+	if err != nil {
+		return categoryError(c, err)
+	}
+
+	response := CategoryData{Name: category.Name, Slug: category.Slug, Children: []*CategoryData{}}
+	if category.ParentID != nil {
+		response.Parent = body.Parent
+	}
+
+	return c.Status(200).JSON(response)
+}
+
+// @Summary Delete category
+// @Description Delete a category without subcategories. Its products stay, they just leave the category. Requires category:write.
+// @Tags Categories
+// @Security Bearer
+// @Produce json
+// @Param slug path string true "Category slug"
+// @Success 200 {object} string "Category deleted"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Category not found"
+// @Failure 409 {object} string "Category has subcategories"
+// @Failure 500 {object} string "Failed to save category"
+// @Router /api/category/{slug} [delete]
+func (h *Catalog) DeleteCategory(c *fiber.Ctx) error {
+	db := h.DB
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		category, err := getCategoryBySlug(tx, c.Params("slug"))
+		if err != nil {
+			return err
+		}
+
+		var children int64
+		if err := tx.Model(&models.Category{}).Where("parent_id = ?", category.ID).Count(&children).Error; err != nil {
+			return err
+		}
+		if children > 0 {
+			return errCategoryHasChildren
+		}
+
+		if err := tx.Exec("DELETE FROM product_categories WHERE category_id = ?", category.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(category).Error
+	})
+	if err != nil {
+		return categoryError(c, err)
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Category deleted successfully"})
+}
+
+// @Summary Set product categories
+// @Description Replace the categories a product belongs to. The product's merchant, or staff with product:write:any.
+// @Tags Products
+// @Security Bearer
+// @Security ApiKey
+// @Accept json
+// @Produce json
+// @Param code path string true "Product code"
+// @Param body body models.SetProductCategoriesValidation true "Category slugs"
+// @Success 200 {object} handler.ProductData "Categories set"
+// @Failure 400 {object} string "Invalid fields or unknown category"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Invalid product code"
+// @Failure 500 {object} string "Failed to set categories"
+// @Router /api/product/{code}/categories [put]
+func (h *Catalog) SetProductCategories(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.SetProductCategoriesValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var product models.Product
+	if err := db.Where(&models.Product{Code: strings.ToUpper(c.Params("code"))}).First(&product).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Invalid product code"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set categories", "data": err})
+	}
+	if !canWriteProduct(user, product.Merchant) {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var categories []models.Category
+	if err := db.Where("slug IN ?", body.Categories).Find(&categories).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set categories", "data": err})
+	}
+	for _, slug := range body.Categories {
+		if !slices.ContainsFunc(categories, func(c models.Category) bool { return c.Slug == slug }) {
+			return c.Status(400).JSON(fiber.Map{"error": "Category not found", "data": slug})
+		}
+	}
+
+	if err := db.Model(&product).Association("Categories").Replace(categories); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set categories", "data": err})
+	}
+	product.Categories = categories
+
+	return c.Status(200).JSON(productData(product))
+}
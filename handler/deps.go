@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"log"
+	"time"
+
+	"github.com/ilhamosaurus/fiber-commerce/biller"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/invoice"
+	"github.com/ilhamosaurus/fiber-commerce/mailer"
+	"github.com/ilhamosaurus/fiber-commerce/signing"
+	"gorm.io/gorm"
+)
+
+// Deps are what the services run with. The helpers they share, such as
+// placing an order or checking a second factor, are its methods.
+type Deps struct {
+	DB       *gorm.DB
+	Config   *config.Config
+	Keys     *signing.KeySet
+	Mailer   mailer.Mailer
+	Invoices *invoice.Generator
+	Billers  *biller.Registry
+	// Now is the clock, time.Now unless a test sets another.
+	Now func() time.Time
+	// Location is the business timezone, UTC unless set.
+	Location *time.Location
+	Logger   *log.Logger
+}
+
+// Auth serves registration, login, tokens, two-factor authentication, email
+// and API keys.
+type Auth struct{ *Deps }
+
+// Accounts serves balances and transfers.
+type Accounts struct{ *Deps }
+
+// Catalog serves products, variants, stock and categories.
+type Catalog struct{ *Deps }
+
+// Orders serves top-ups, carts, payments, refunds and order status.
+type Orders struct{ *Deps }
+
+// Billing serves bill payments and subscriptions.
+type Billing struct{ *Deps }
+
+// Admin serves the staff endpoints.
+type Admin struct{ *Deps }
+
+// Services are every service, built from the same Deps.
+type Services struct {
+	*Deps
+	Auth     *Auth
+	Accounts *Accounts
+	Catalog  *Catalog
+	Orders   *Orders
+	Billing  *Billing
+	Admin    *Admin
+}
+
+// New builds the services from d. The clock, business timezone and logger
+// default to time.Now, UTC and the standard logger.
+func New(d Deps) *Services {
+	if d.Now == nil {
+		d.Now = time.Now
+	}
+	if d.Location == nil {
+		d.Location = time.UTC
+	}
+	if d.Logger == nil {
+		d.Logger = log.Default()
+	}
+	deps := &d
+	return &Services{
+		Deps:     deps,
+		Auth:     &Auth{deps},
+		Accounts: &Accounts{deps},
+		Catalog:  &Catalog{deps},
+		Orders:   &Orders{deps},
+		Billing:  &Billing{deps},
+		Admin:    &Admin{deps},
+	}
+}
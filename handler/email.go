@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/mailer"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvalidEmailToken = errors.New("invalid email token")
+	errEmailTaken        = errors.New("email already registered")
+)
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func getUserByEmail(db *gorm.DB, email string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// createEmailToken voids the unused purpose tokens of username and returns
+// a new one for email.
+func (h *Auth) createEmailToken(tx *gorm.DB, username string, purpose models.TokenPurpose, email string, ttl time.Duration) (string, error) {
+	if err := tx.Model(&models.EmailToken{}).
+		Where("owner = ? AND purpose = ? AND used_at IS NULL", username, purpose).
+		Update("used_at", h.Now()).Error; err != nil {
+		return "", err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	if err := tx.Create(&models.EmailToken{
+		Owner:     username,
+		Purpose:   purpose,
+		Email:     email,
+		TokenHash: util.HashToken(token),
+		ExpiresAt: h.Now().Add(ttl),
+	}).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useEmailToken marks token used and returns it, once and only before it
+// expires.
+func (h *Auth) useEmailToken(tx *gorm.DB, token string, purpose models.TokenPurpose) (*models.EmailToken, error) {
+	now := h.Now()
+	hash := util.HashToken(token)
+	res := tx.Model(&models.EmailToken{}).
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hash, purpose, now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errInvalidEmailToken
+	}
+
+	var used models.EmailToken
+	if err := tx.Where(&models.EmailToken{TokenHash: hash}).First(&used).Error; err != nil {
+		return nil, err
+	}
+	return &used, nil
+}
+
+// sendEmailToken mails token to to, with a link to path on the app URL when
+// it is configured.
+func (h *Auth) sendEmailToken(to, subject, intro, path, token string) error {
+	body := fmt.Sprintf("%s\n\nYour token: %s\n", intro, token)
+	if base := h.Config.Server.AppURL; base != "" {
+		body += fmt.Sprintf("\n%s%s?token=%s\n", strings.TrimRight(base, "/"), path, url.QueryEscape(token))
+	}
+	body += "\nIf you did not ask for this, you can ignore this email.\n"
+	return h.Mailer.Send(mailer.Message{To: to, Subject: subject, Body: body})
+}
+
+// sendVerificationEmail mails username a token that verifies email.
+func (h *Auth) sendVerificationEmail(username, email string) error {
+	var token string
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		token, err = h.createEmailToken(tx, username, models.VerifyEmail, email, h.Config.Auth.EmailVerificationTTL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return h.sendEmailToken(email, "Verify your email", "Confirm this address for your fiber-commerce account.", "/verify-email", token)
+}
+
+// @Summary	Verify email
+// @Tags		Auth
+// @Description Confirm the email address of an account with the token mailed to it.
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.VerifyEmailValidation	true	"Token"
+// @Success	200		{object}	string	"Email verified"
+// @Failure	400		{object}	string	"Invalid fields, or invalid or expired token"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/verify-email [post]
+func (h *Auth) VerifyEmail(c *fiber.Ctx) error {
+	db := h.DB
+
+	body := &models.VerifyEmailValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		token, err := h.useEmailToken(tx, body.Token, models.VerifyEmail)
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&models.User{}).
+			Where("username = ? AND email = ?", token.Owner, token.Email).
+			Update("email_verified_at", h.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidEmailToken
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidEmailToken) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to verify email", "data": err})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Email verified"})
+}
+
+// @Summary	Resend verification email
+// @Tags		Auth
+// @Description Mail a new verification token to the user's email. Earlier tokens stop working.
+// @Security Bearer
+// @Produce	json
+// @Success	200		{object}	string	"Verification email sent"
+// @Failure	401		{object}	string	"Unauthorized"
+// @Failure	409		{object}	string	"No email set, or email already verified"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/verify-email/resend [post]
+func (h *Auth) ResendVerificationEmail(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	account, err := h.getUserByUsername(user.Username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to find user", "data": err})
+	}
+	if account == nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	if account.Email == nil {
+		return c.Status(409).JSON(fiber.Map{"error": "No email set"})
+	}
+	if account.EmailVerifiedAt != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Email already verified"})
+	}
+
+	if err := h.sendVerificationEmail(account.Username, *account.Email); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to send verification email", "data": err.Error()})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Verification email sent"})
+}
+
+// @Summary	Change email
+// @Tags		Auth
+// @Description Set or change the user's email, confirmed with the password. The new address is unverified until the token mailed to it is used.
+// @Security Bearer
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.ChangeEmailValidation	true	"Email"
+// @Success	200		{object}	string	"Email changed"
+// @Failure	400		{object}	string	"Invalid fields"
+// @Failure	401		{object}	string	"Unauthorized or wrong password"
+// @Failure	409		{object}	string	"Email already registered"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/email [put]
+func (h *Auth) ChangeEmail(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.ChangeEmailValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	account, err := h.getUserByUsername(user.Username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to find user", "data": err})
+	}
+	if account == nil || !util.CheckPasswordHash(body.Password, account.Password) {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	email := normalizeEmail(body.Email)
+	if account.Email != nil && *account.Email == email {
+		return c.Status(200).JSON(fiber.Map{"message": "Email unchanged"})
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		taken, err := getUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		if taken != nil {
+			return errEmailTaken
+		}
+		return tx.Model(account).Updates(map[string]interface{}{"email": email, "email_verified_at": nil}).Error
+	})
+	if errors.Is(err, errEmailTaken) {
+		return c.Status(409).JSON(fiber.Map{"error": "Email already registered"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to change email", "data": err})
+	}
+
+	if err := h.sendVerificationEmail(account.Username, email); err != nil {
+		h.Logger.Printf("failed to send verification email to %s: %v", account.Username, err)
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Email changed, check your inbox to verify it"})
+}
+
+// @Summary	Forgot password
+// @Tags		Auth
+// @Description Mail a password reset token to a verified email. The response is the same whether or not the email belongs to an account.
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.ForgotPasswordValidation	true	"Email"
+// @Success	200		{object}	string	"Reset email sent if the account exists"
+// @Failure	400		{object}	string	"Invalid fields"
+// @Router		/api/auth/forgot-password [post]
+func (h *Auth) ForgotPassword(c *fiber.Ctx) error {
+	db := h.DB
+
+	body := &models.ForgotPasswordValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	// failures are only logged, so the response never tells whether the
+	// email is registered
+	response := fiber.Map{"message": "If the email belongs to an account, a password reset token has been sent to it"}
+
+	email := normalizeEmail(body.Email)
+	user, err := getUserByEmail(db, email)
+	if err != nil {
+		h.Logger.Printf("failed to find user for password reset: %v", err)
+		return c.Status(200).JSON(response)
+	}
+	if user == nil || user.EmailVerifiedAt == nil || user.SuspendedAt != nil {
+		return c.Status(200).JSON(response)
+	}
+
+	var token string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		token, err = h.createEmailToken(tx, user.Username, models.ResetPassword, email, h.Config.Auth.PasswordResetTTL)
+		return err
+	})
+	if err == nil {
+		err = h.sendEmailToken(email, "Reset your password", "Someone asked to reset the password of your fiber-commerce account.", "/reset-password", token)
+	}
+	if err != nil {
+		h.Logger.Printf("failed to send password reset to %s: %v", user.Username, err)
+	}
+
+	return c.Status(200).JSON(response)
+}
+
+// @Summary	Reset password
+// @Tags		Auth
+// @Description Set a new password with a token from forgot-password. Every session of the user is logged out.
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.ResetPasswordValidation	true	"Token and new password"
+// @Success	200		{object}	string	"Password reset"
+// @Failure	400		{object}	string	"Invalid fields, or invalid or expired token"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/reset-password [post]
+func (h *Auth) ResetPassword(c *fiber.Ctx) error {
+	db := h.DB
+
+	body := &models.ResetPasswordValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	hash, err := util.HashedPassword(body.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to hash password", "data": err})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		token, err := h.useEmailToken(tx, body.Token, models.ResetPassword)
+		if err != nil {
+			return err
+		}
+		// a token mailed to an address the user has since replaced is void
+		res := tx.Model(&models.User{}).
+			Where("username = ? AND email = ? AND suspended_at IS NULL", token.Owner, token.Email).
+			Update("password", hash)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidEmailToken
+		}
+		return h.revokeRefreshTokens(tx, "owner = ?", token.Owner)
+	})
+	if errors.Is(err, errInvalidEmailToken) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to reset password", "data": err})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Password reset, please login"})
+}
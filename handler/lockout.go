@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func userThrottleKey(username string) string {
+	return "user:" + username
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginLockedUntil returns when the lock on the username or the address
+// ends, or the zero time when neither is locked.
+func (h *Auth) loginLockedUntil(username, ip string) (time.Time, error) {
+	var throttles []models.LoginThrottle
+	if err := h.DB.Where("key IN ? AND locked_until > ?", []string{userThrottleKey(username), ipThrottleKey(ip)}, h.Now()).
+		Find(&throttles).Error; err != nil {
+		return time.Time{}, err
+	}
+	var until time.Time
+	for _, t := range throttles {
+		if t.LockedUntil.After(until) {
+			until = *t.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// address, whether or not the username exists, and locks either one that
+// ran out of attempts.
+func (h *Auth) recordLoginFailure(username, ip string) error {
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := h.failLogin(tx, userThrottleKey(username), h.Config.Auth.LoginMaxAttempts, ip); err != nil {
+			return err
+		}
+		return h.failLogin(tx, ipThrottleKey(ip), h.Config.Auth.LoginIPMaxAttempts, ip)
+	})
+}
+
+func (h *Auth) failLogin(tx *gorm.DB, key string, maxAttempts int, ip string) error {
+	now := h.Now()
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.LoginThrottle{Key: key, LastFailedAt: now}).Error; err != nil {
+		return err
+	}
+	var throttle models.LoginThrottle
+	if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where("key = ?", key).First(&throttle).Error; err != nil {
+		return err
+	}
+
+	// failures are forgotten once the key has been quiet for the window,
+	// counted from the end of its last lock
+	quietSince := throttle.LastFailedAt
+	if throttle.LockedUntil != nil && throttle.LockedUntil.After(quietSince) {
+		quietSince = *throttle.LockedUntil
+	}
+	if now.Sub(quietSince) > h.Config.Auth.LoginAttemptWindow {
+		throttle.Failures = 0
+	}
+	throttle.Failures++
+	throttle.LastFailedAt = now
+
+	if throttle.Failures >= maxAttempts {
+		lockout := h.Config.Auth.LoginLockout
+		maxLockout := h.Config.Auth.LoginMaxLockout
+		for i := maxAttempts; i < throttle.Failures && lockout < maxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > maxLockout {
+			lockout = maxLockout
+		}
+		until := now.Add(lockout)
+		throttle.LockedUntil = &until
+
+		if err := tx.Create(&models.AuditEvent{
+			Action:  models.AuditLoginLockout,
+			Subject: key,
+			IP:      ip,
+			Detail:  fmt.Sprintf("locked for %s after %d failed logins", lockout, throttle.Failures),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Save(&throttle).Error
+}
+
+// clearLoginFailures forgets the failed logins of username after it logged
+// in. The address keeps its count, so logging into one account does not buy
+// more guesses at others.
+func (h *Auth) clearLoginFailures(username string) error {
+	return h.DB.Where("key = ?", userThrottleKey(username)).Delete(&models.LoginThrottle{}).Error
+}
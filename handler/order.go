@@ -7,13 +7,266 @@ import (
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/ilhamosaurus/fiber-commerce/database"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
 	"github.com/ilhamosaurus/fiber-commerce/models"
 	"github.com/ilhamosaurus/fiber-commerce/util"
 	"gorm.io/gorm"
 )
 
+var (
+	errAccountNotFound     = errors.New("account not found")
+	errMerchantNotFound    = errors.New("merchant not found")
+	errInsufficientBalance = errors.New("insufficient balance")
+	errCurrencyMismatch    = errors.New("currency mismatch")
+	errEmptyOrder          = errors.New("order has no items")
+)
+
+// orderLine is one product or variant of a purchase, priced when the order
+// is placed.
+type orderLine struct {
+	Product *ProductData
+	Variant *VariantData
+	// Amount is set for bills, whose amount due comes from the biller
+	// rather than the catalog.
+	Amount *models.Money
+	Qty    int
+}
+
+func (l orderLine) unitPrice() models.Money {
+	if l.Amount != nil {
+		return *l.Amount
+	}
+	if l.Variant != nil {
+		return l.Variant.Price
+	}
+	return l.Product.Price
+}
+
+// subtotal is what the line costs, ErrMoneyOverflow when that is more
+// than Money holds.
+func (l orderLine) subtotal() (models.Money, error) {
+	return l.unitPrice().Mul(l.Qty)
+}
+
+// linesTotal is what lines cost together, before the order is placed.
+func linesTotal(lines []orderLine) (models.Money, error) {
+	var total models.Money
+	for _, line := range lines {
+		subtotal, err := line.subtotal()
+		if err != nil {
+			return 0, err
+		}
+		if total, err = total.Add(subtotal); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (l orderLine) name() string {
+	if l.Variant != nil {
+		return fmt.Sprintf("%s (%s)", l.Product.Name, l.Variant.Name)
+	}
+	return l.Product.Name
+}
+
+func (l orderLine) sku() *string {
+	if l.Variant != nil {
+		return &l.Variant.SKU
+	}
+	return nil
+}
+
+type OrderItemData struct {
+	Code      string          `json:"code"`
+	SKU       *string         `json:"sku"`
+	Name      string          `json:"name"`
+	Merchant  string          `json:"merchant"`
+	UnitPrice models.Money    `json:"unit_price"`
+	Currency  models.Currency `json:"currency"`
+	Qty       int             `json:"qty"`
+	Subtotal  models.Money    `json:"subtotal"`
+}
+
+// placeOrder charges buyer for lines inside tx. The buyer gets one PAYMENT
+// order carrying the line items, every merchant in the order gets a REVENUE
+// order for its share, and the money moves in a single journal entry.
+func (d *Deps) placeOrder(tx *gorm.DB, buyer string, lines []orderLine) (*models.Order, error) {
+	if len(lines) == 0 {
+		return nil, errEmptyOrder
+	}
+
+	currency := lines[0].Product.Currency
+	items := make([]models.OrderItem, len(lines))
+	merchants := make([]string, 0)
+	shares := make(map[string]models.Money)
+	var total models.Money
+	for i, line := range lines {
+		if line.Product.Currency != currency {
+			return nil, errCurrencyMismatch
+		}
+		subtotal, err := line.subtotal()
+		if err != nil {
+			return nil, err
+		}
+		items[i] = models.OrderItem{
+			ProductCode: line.Product.Code,
+			ProductName: line.name(),
+			VariantSKU:  line.sku(),
+			Merchant:    line.Product.Merchant,
+			UnitPrice:   line.unitPrice(),
+			Currency:    currency,
+			Qty:         line.Qty,
+			Subtotal:    subtotal,
+		}
+		if _, ok := shares[line.Product.Merchant]; !ok {
+			merchants = append(merchants, line.Product.Merchant)
+		}
+		if shares[line.Product.Merchant], err = shares[line.Product.Merchant].Add(subtotal); err != nil {
+			return nil, err
+		}
+		if total, err = total.Add(subtotal); err != nil {
+			return nil, err
+		}
+	}
+
+	accounts, err := lockAccounts(tx, append([]string{buyer}, merchants...)...)
+	if err != nil {
+		return nil, err
+	}
+	buyerAccount := accounts[buyer]
+	if buyerAccount == nil {
+		return nil, errAccountNotFound
+	}
+	if buyerAccount.Currency != currency {
+		return nil, errCurrencyMismatch
+	}
+	for _, merchant := range merchants {
+		if accounts[merchant] == nil {
+			return nil, errMerchantNotFound
+		}
+	}
+
+	// balance check against the locked row
+	if total > buyerAccount.Balance {
+		return nil, errInsufficientBalance
+	}
+
+	description := fmt.Sprintf("Payment for product %s(%s)", lines[0].name(), lines[0].Product.Code)
+	if len(lines) > 1 {
+		description = fmt.Sprintf("Payment for %d products", len(lines))
+	}
+
+	buyerUtil, err := d.GetInvNumber(buyer)
+	if err != nil {
+		return nil, err
+	}
+	payment := models.Order{
+		AccountID:   buyerAccount.ID,
+		Invoice:     buyerUtil.Invoice,
+		Amount:      total,
+		Currency:    currency,
+		Type:        models.Type("PAYMENT"),
+		Status:      models.Paid,
+		Buyer:       &buyer,
+		Description: &description,
+		Items:       items,
+	}
+	if len(merchants) == 1 {
+		payment.Merchant = &merchants[0]
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&models.OrderStatusHistory{OrderID: payment.ID, ToStatus: payment.Status, Actor: buyer}).Error; err != nil {
+		return nil, err
+	}
+	if err := reserveStock(tx, &payment, buyer); err != nil {
+		return nil, err
+	}
+
+	postings := []models.Posting{ledger.DebitAccount(buyerAccount, total, &payment.ID)}
+	for _, merchant := range merchants {
+		merchantUtil, err := d.GetInvNumber(merchant)
+		if err != nil {
+			return nil, err
+		}
+		revenue := models.Order{
+			AccountID:   accounts[merchant].ID,
+			Invoice:     merchantUtil.Invoice,
+			Amount:      shares[merchant],
+			Currency:    currency,
+			Type:        models.Type("REVENUE"),
+			Status:      payment.Status,
+			PurchaseID:  &payment.ID,
+			Merchant:    &merchant,
+			Buyer:       &buyer,
+			Description: &description,
+		}
+		if err := tx.Create(&revenue).Error; err != nil {
+			return nil, err
+		}
+		postings = append(postings, ledger.CreditAccount(accounts[merchant], shares[merchant], &revenue.ID))
+	}
+
+	if err := ledger.Post(tx, &models.JournalEntry{
+		Reference:   payment.Invoice,
+		Description: &description,
+		Postings:    postings,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+// orderError writes the response for an error returned by placeOrder.
+func orderError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errInsufficientBalance):
+		return c.Status(400).JSON(fiber.Map{"error": "Insufficient balance"})
+	case errors.Is(err, errCurrencyMismatch):
+		return c.Status(400).JSON(fiber.Map{"error": "Product currency does not match account currency"})
+	case errors.Is(err, errEmptyOrder):
+		return c.Status(400).JSON(fiber.Map{"error": "Order has no items"})
+	case errors.Is(err, errAccountNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	case errors.Is(err, errMerchantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Merchant not found"})
+	case errors.Is(err, errProductNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	case errors.Is(err, errVariantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Variant not found"})
+	case errors.Is(err, errBillProduct):
+		return c.Status(400).JSON(fiber.Map{"error": "Product is a bill, pay it through bill inquiry"})
+	case errors.Is(err, errVariantRequired):
+		return c.Status(400).JSON(fiber.Map{"error": "Product is sold by variant, pass its SKU"})
+	case errors.Is(err, errInsufficientStock):
+		return c.Status(409).JSON(fiber.Map{"error": "Insufficient stock", "data": err.Error()})
+	case errors.Is(err, models.ErrMoneyOverflow):
+		return c.Status(400).JSON(fiber.Map{"error": "Order amount is too large"})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
+	}
+}
+
+func orderItemData(items []models.OrderItem) []OrderItemData {
+	data := make([]OrderItemData, len(items))
+	for i, item := range items {
+		data[i] = OrderItemData{
+			Code:      item.ProductCode,
+			SKU:       item.VariantSKU,
+			Name:      item.ProductName,
+			Merchant:  item.Merchant,
+			UnitPrice: item.UnitPrice,
+			Currency:  item.Currency,
+			Qty:       item.Qty,
+			Subtotal:  item.Subtotal,
+		}
+	}
+	return data
+}
+
 // @Summary Topup user's balance
 // @Tags Transaction
 // @Description Topup user's balance
@@ -21,23 +274,28 @@ import (
 // @Accept json
 // @Produce json
 // @Param body body models.TopupValidation true "Topup"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
 // @Success 201 {object} handler.Topup.TopupResponse "OK"
 // @Failure 400 {object} string "Invalid fields"
 // @Failure 401 {object} string "Unauthorized"
+// @Failure 409 {object} string "Request with this Idempotency-Key in progress"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
 // @Failure 500 {object} string "Failed to topup"
 // @Router /api/transaction/topup [post]
-func Topup(c *fiber.Ctx) error {
+func (h *Orders) Topup(c *fiber.Ctx) error {
 	type TopupResponse struct {
-		Invoice   string      `json:"invoice"`
-		Amount    float64     `json:"amount"`
-		Type      models.Type `json:"type"`
-		CreatedAt time.Time   `json:"created_at"`
+		Invoice   string          `json:"invoice"`
+		Amount    models.Money    `json:"amount"`
+		Currency  models.Currency `json:"currency"`
+		Type      models.Type     `json:"type"`
+		CreatedAt time.Time       `json:"created_at"`
 	}
-	user := c.Locals("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
-	db := database.DB
-	var err error
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
 
 	body := &models.TopupValidation{}
 	if err := c.BodyParser(body); err != nil {
@@ -53,7 +311,7 @@ func Topup(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
 	}
 
-	transactionUtil, err := GetInvNumber(username)
+	transactionUtil, err := h.GetInvNumber(username)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to topup", "data": err})
 	}
@@ -64,18 +322,44 @@ func Topup(c *fiber.Ctx) error {
 		AccountID: transactionUtil.Account.ID,
 		Invoice:   transactionUtil.Invoice,
 		Amount:    body.Amount,
+		Currency:  transactionUtil.Account.Currency,
 		Type:      models.Type("TOPUP"),
+		Status:    models.Completed,
 	}
 
-	tx := db.Session(&gorm.Session{SkipDefaultTransaction: true})
-	tx.Model(&models.Account{}).Where("owner = ?", username).Update("balance", gorm.Expr("balance + ?", body.Amount))
-	if err := tx.Create(&transaction).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		accounts, err := lockAccounts(tx, username)
+		if err != nil {
+			return err
+		}
+		account := accounts[username]
+		if account == nil {
+			return errAccountNotFound
+		}
+
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		return ledger.Post(tx, &models.JournalEntry{
+			Reference: transaction.Invoice,
+			Postings: []models.Posting{
+				ledger.DebitSystem(ledger.External, body.Amount, account.Currency),
+				ledger.CreditAccount(account, body.Amount, &transaction.ID),
+			},
+		})
+	})
+	if errors.Is(err, errAccountNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	}
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to topup", "data": err})
 	}
 
 	response := TopupResponse{
 		Invoice:   transactionUtil.Invoice,
 		Amount:    body.Amount,
+		Currency:  transaction.Currency,
 		Type:      models.Type("TOPUP"),
 		CreatedAt: transaction.CreatedAt,
 	}
@@ -88,31 +372,41 @@ func Topup(c *fiber.Ctx) error {
 
 // @Summary Get user's transactions
 // @Tags Transaction
-// @Description Get user's transactions history
+// @Description Get user's transactions history. API keys with the orders:read scope may read it too.
 // @Security Bearer
+// @Security ApiKey
 // @Produce json
 // @Success 200 {object} handler.GetOrders.OrderResponse
 // @Failure 401 {object} string "Unauthorized"
 // @Failure 404 {object} string "No transactions found"
 // @Failure 500 {object} string "Failed to get transactions"
 // @Router /api/transaction/history [get]
-func GetOrders(c *fiber.Ctx) error {
+func (h *Orders) GetOrders(c *fiber.Ctx) error {
 	page := c.QueryInt("page")
 	pageSize := c.QueryInt("page_size")
 
 	type OrderResponse struct {
-		Invoice   string      `json:"invoice"`
-		Merchant  *string     `json:"merchant"`
-		Buyer     *string     `json:"buyer"`
-		Amount    float64     `json:"amount"`
-		Type      models.Type `json:"type"`
-		CreatedAt time.Time   `json:"created_at"`
+		Invoice         string             `json:"invoice"`
+		Merchant        *string            `json:"merchant"`
+		Buyer           *string            `json:"buyer"`
+		Amount          models.Money       `json:"amount"`
+		Currency        models.Currency    `json:"currency"`
+		Type            models.Type        `json:"type"`
+		Status          models.OrderStatus `json:"status"`
+		Reference       *string            `json:"reference"`
+		Description     *string            `json:"description"`
+		BillerReference *string            `json:"biller_reference"`
+		BillerToken     *string            `json:"biller_token"`
+		CreatedAt       time.Time          `json:"created_at"`
 	}
 
-	user := util.CurrentUser(c)
-	db := database.DB
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
 
-	account, err := GetAccountByUsername(user.Username)
+	account, err := h.GetAccountByUsername(user.Username)
 	if err != nil || account == nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Failed to get account", "data": err})
 	}
@@ -137,12 +431,18 @@ func GetOrders(c *fiber.Ctx) error {
 		paginatedResponse := make([]OrderResponse, len(orders))
 		for i, order := range orders {
 			paginatedResponse[i] = OrderResponse{
-				Invoice:   order.Invoice,
-				Merchant:  order.Merchant,
-				Buyer:     order.Buyer,
-				Amount:    order.Amount,
-				Type:      order.Type,
-				CreatedAt: order.CreatedAt,
+				Invoice:         order.Invoice,
+				Merchant:        order.Merchant,
+				Buyer:           order.Buyer,
+				Amount:          order.Amount,
+				Currency:        order.Currency,
+				Type:            order.Type,
+				Status:          order.Status,
+				Reference:       order.Reference,
+				Description:     order.Description,
+				BillerReference: order.BillerReference,
+				BillerToken:     order.BillerToken,
+				CreatedAt:       order.CreatedAt,
 			}
 		}
 
@@ -158,12 +458,18 @@ func GetOrders(c *fiber.Ctx) error {
 	orderResponse := make([]OrderResponse, len(orders))
 	for i, order := range orders {
 		orderResponse[i] = OrderResponse{
-			Invoice:   order.Invoice,
-			Merchant:  order.Merchant,
-			Buyer:     order.Buyer,
-			Amount:    order.Amount,
-			Type:      order.Type,
-			CreatedAt: order.CreatedAt,
+			Invoice:         order.Invoice,
+			Merchant:        order.Merchant,
+			Buyer:           order.Buyer,
+			Amount:          order.Amount,
+			Currency:        order.Currency,
+			Type:            order.Type,
+			Status:          order.Status,
+			Reference:       order.Reference,
+			Description:     order.Description,
+			BillerReference: order.BillerReference,
+			BillerToken:     order.BillerToken,
+			CreatedAt:       order.CreatedAt,
 		}
 	}
 
@@ -172,30 +478,40 @@ func GetOrders(c *fiber.Ctx) error {
 
 // @Summary Payment
 // @Tags Transaction
-// @Description User's purchase products and pay the merchant
+// @Description User's purchase products and pay the merchant. Products with variants are bought by variant SKU. Users with two-factor authentication send a code in X-2FA-Code from STEP_UP_THRESHOLD.
 // @Security Bearer
 // @Accept json
 // @Produce json
 // @Param payment body models.PaymentValidation true "Payment"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Param X-2FA-Code header string false "Two-factor code, for amounts from STEP_UP_THRESHOLD"
 // @Success 201 {object} handler.Payment.PaymentResponse
-// @Failure 400 {object} string "Invalid Fields"
-// @Failure 401 {object} string "Unauthorized"
-// @Failure 404 {object} string "Product not found"
+// @Failure 400 {object} string "Invalid Fields, or product is sold by variant"
+// @Failure 401 {object} string "Unauthorized, or two-factor code missing or invalid"
+// @Failure 404 {object} string "Product or variant not found"
+// @Failure 409 {object} string "Insufficient stock, or request with this Idempotency-Key in progress"
+// @Failure 429 {object} string "Too many invalid two-factor codes"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
 // @Failure 500 {object} string "Failed to payment"
 // @Router /api/transaction/payment [post]
-func Payment(c *fiber.Ctx) error {
+func (h *Orders) Payment(c *fiber.Ctx) error {
 	type PaymentResponse struct {
-		Invoice   string      `json:"invoice"`
-		Merchant  *string     `json:"merchant"`
-		Buyer     *string     `json:"buyer"`
-		Amount    float64     `json:"amount"`
-		Type      models.Type `json:"type"`
-		CreatedAt time.Time   `json:"created_at"`
-	}
-	user := c.Locals("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
-	db := database.DB
+		Invoice   string             `json:"invoice"`
+		Merchant  *string            `json:"merchant"`
+		Buyer     *string            `json:"buyer"`
+		Amount    models.Money       `json:"amount"`
+		Currency  models.Currency    `json:"currency"`
+		Type      models.Type        `json:"type"`
+		Status    models.OrderStatus `json:"status"`
+		Items     []OrderItemData    `json:"items"`
+		CreatedAt time.Time          `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
 
 	body := &models.PaymentValidation{}
 	if err := c.BodyParser(body); err != nil {
@@ -211,62 +527,25 @@ func Payment(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
 	}
 
-	transactionUtil, err := GetInvNumber(username)
+	line, err := h.resolveLine(body.Code, body.SKU, body.Qty)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
+		return orderError(c, err)
 	}
-	if transactionUtil == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
-	}
-
-	product, err := GetProductByCode(body.Code)
-	if err != nil || product == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Product not found", "data": err})
-	}
-	// balance check
-	totalAmount := product.Price * float64(body.Qty)
-	if totalAmount > transactionUtil.Account.Balance {
-		return c.Status(400).JSON(fiber.Map{"error": "Insufficient balance"})
-	}
-
-	merchatUtil, err := GetInvNumber(product.Merchant)
-	if err != nil || merchatUtil == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Merchant not found", "data": err})
-	}
-
-	description := fmt.Sprintf("Payment for product %s(%s)", product.Name, product.Code)
-	merchantTransaction := models.Order{
-		AccountID:   merchatUtil.Account.ID,
-		Invoice:     merchatUtil.Invoice,
-		Amount:      product.Price,
-		Type:        models.Type("REVENUE"),
-		Merchant:    &product.Merchant,
-		Buyer:       &username,
-		Description: &description,
+	total, err := linesTotal([]orderLine{*line})
+	if err != nil {
+		return orderError(c, err)
 	}
-
-	transaction := models.Order{
-		AccountID:   transactionUtil.Account.ID,
-		Invoice:     transactionUtil.Invoice,
-		Amount:      totalAmount,
-		Type:        models.Type("PAYMENT"),
-		Merchant:    &product.Merchant,
-		Buyer:       &username,
-		Description: &description,
+	if err := h.requireStepUp(c, username, total); err != nil {
+		return twoFactorError(c, err)
 	}
 
-	tx := db.Session(&gorm.Session{SkipDefaultTransaction: true})
-	if err := tx.Model(&models.Account{}).Where("owner = ?", username).Update("balance", gorm.Expr("balance - ?", totalAmount)).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
-	}
-	if err := tx.Model(&models.Account{}).Where("owner = ?", product.Merchant).Update("balance", gorm.Expr("balance + ?", totalAmount)).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
-	}
-	if err := tx.Create(&transaction).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
-	}
-	if err := tx.Create(&merchantTransaction).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to purchase", "data": err})
+	var transaction *models.Order
+	err = db.Transaction(func(tx *gorm.DB) error {
+		transaction, err = h.placeOrder(tx, username, []orderLine{*line})
+		return err
+	})
+	if err != nil {
+		return orderError(c, err)
 	}
 
 	paymentResponse := PaymentResponse{
@@ -274,7 +553,10 @@ func Payment(c *fiber.Ctx) error {
 		Merchant:  transaction.Merchant,
 		Buyer:     transaction.Buyer,
 		Amount:    transaction.Amount,
+		Currency:  transaction.Currency,
 		Type:      transaction.Type,
+		Status:    transaction.Status,
+		Items:     orderItemData(transaction.Items),
 		CreatedAt: transaction.CreatedAt,
 	}
 
@@ -1,88 +1,281 @@
 package handler
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
-	"github.com/ilhamosaurus/fiber-commerce/database"
 	"github.com/ilhamosaurus/fiber-commerce/models"
 	"github.com/ilhamosaurus/fiber-commerce/util"
 	"gorm.io/gorm"
 )
 
 type ProductData struct {
-	Code     string   `json:"code"`
-	Name     string   `json:"name"`
-	Price    float64  `json:"price"`
-	Weight   *float64 `json:"weight"`
-	Merchant string   `json:"merchant"`
+	Code     string          `json:"code"`
+	Name     string          `json:"name"`
+	Price    models.Money    `json:"price"`
+	Currency models.Currency `json:"currency"`
+	Weight   *float64        `json:"weight"`
+	Merchant string          `json:"merchant"`
+	// Stock is nil for products that are not stock tracked.
+	Stock             *int `json:"stock"`
+	LowStockThreshold int  `json:"low_stock_threshold"`
+	LowStock          bool `json:"low_stock"`
+	// Biller is set for bill-payment products, paid through bill inquiry.
+	Biller       *string `json:"biller"`
+	Subscribable bool    `json:"subscribable"`
+	// Categories are the slugs of the product's categories.
+	Categories []string `json:"categories"`
+	// Options holds the values of each variant option, Variants the matrix.
+	Options  map[string][]string `json:"options"`
+	Variants []VariantData       `json:"variants"`
 }
 
-func GetProducts() (*[]ProductData, error) {
-	db := database.DB
-	var products []models.Product
+func orderCategories(db *gorm.DB) *gorm.DB {
+	return db.Order("slug")
+}
 
-	if err := db.Select("code", "name", "price", "weight").Find(&products).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
+func productData(p models.Product) ProductData {
+	categories := make([]string, len(p.Categories))
+	for i, c := range p.Categories {
+		categories[i] = c.Slug
+	}
+
+	variants := make([]VariantData, len(p.Variants))
+	for i, v := range p.Variants {
+		variants[i] = variantData(v, p.LowStockThreshold)
+	}
+
+	return ProductData{
+		Code:              p.Code,
+		Name:              p.Name,
+		Price:             p.Price,
+		Currency:          p.Currency,
+		Weight:            p.Weight,
+		Merchant:          p.Merchant,
+		Stock:             p.Stock,
+		LowStockThreshold: p.LowStockThreshold,
+		LowStock:          p.IsLowStock(),
+		Biller:            p.Biller,
+		Subscribable:      p.Subscribable,
+		Categories:        categories,
+		Options:           variantOptions(p.Variants),
+		Variants:          variants,
+	}
+}
+
+// ProductPage is one page of products. NextCursor is nil on the last page.
+type ProductPage struct {
+	Data       []ProductData `json:"data"`
+	NextCursor *string       `json:"next_cursor"`
+	Total      int64         `json:"total"`
+}
+
+var (
+	errInvalidCursor = errors.New("invalid cursor")
+	errInvalidPrice  = errors.New("invalid price")
+)
+
+// productCursor is the position after the last product of a page. It carries
+// the sort it was made for, since keyset positions do not carry over.
+type productCursor struct {
+	Sort      string       `json:"s"`
+	Order     string       `json:"o"`
+	Price     models.Money `json:"p,omitempty"`
+	Name      string       `json:"n,omitempty"`
+	CreatedAt time.Time    `json:"c,omitempty"`
+	ID        uint         `json:"id"`
+}
+
+func (cur productCursor) value() interface{} {
+	switch cur.Sort {
+	case "price":
+		return cur.Price
+	case "name":
+		return cur.Name
+	default:
+		return cur.CreatedAt
+	}
+}
+
+func (cur productCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeProductCursor(s string) (*productCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cur productCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &cur, nil
+}
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// GetProducts returns the page of products matching query. Products are
+// ordered by the sort column and then id, so the cursor is an exact keyset
+// position and pages neither skip nor repeat rows.
+func (h *Catalog) GetProducts(query models.ProductQuery) (*ProductPage, error) {
+	db := h.DB
+
+	sort, order := query.Sort, query.Order
+	if sort == "" {
+		sort = "created_at"
+	}
+	if order == "" {
+		order = "desc"
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = 20
+	}
+
+	filtered := db.Model(&models.Product{})
+	if q := strings.TrimSpace(query.Q); q != "" {
+		pattern := "%" + escapeLike(q) + "%"
+		filtered = filtered.Where("(name ILIKE ? OR code ILIKE ?)", pattern, pattern)
+	}
+	if query.Merchant != "" {
+		filtered = filtered.Where("merchant = ?", query.Merchant)
+	}
+	if query.Category != "" {
+		filtered = filtered.Where("id IN (?)", db.Table("product_categories").
+			Select("product_id").
+			Where("category_id IN (?)", categorySubtree(db, query.Category)))
+	}
+	if query.MinPrice != "" {
+		minPrice, err := models.ParseMoney(query.MinPrice)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidPrice, err)
+		}
+		filtered = filtered.Where("price >= ?", minPrice)
+	}
+	if query.MaxPrice != "" {
+		maxPrice, err := models.ParseMoney(query.MaxPrice)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidPrice, err)
 		}
+		filtered = filtered.Where("price <= ?", maxPrice)
+	}
+
+	var total int64
+	if err := filtered.Session(&gorm.Session{}).Count(&total).Error; err != nil {
 		return nil, err
 	}
 
-	productData := make([]ProductData, len(products))
-	for i, p := range products {
-		productData[i] = ProductData{
-			Code:     p.Code,
-			Name:     p.Name,
-			Price:    p.Price,
-			Weight:   p.Weight,
-			Merchant: p.Merchant,
+	page := filtered.Session(&gorm.Session{})
+	if query.Cursor != "" {
+		cur, err := decodeProductCursor(query.Cursor)
+		if err != nil {
+			return nil, err
 		}
+		if cur.Sort != sort || cur.Order != order {
+			return nil, errInvalidCursor
+		}
+		cmp := ">"
+		if order == "desc" {
+			cmp = "<"
+		}
+		page = page.Where(fmt.Sprintf("(%s, id) %s (?, ?)", sort, cmp), cur.value(), cur.ID)
+	}
+
+	var products []models.Product
+	if err := page.Preload("Categories", orderCategories).Preload("Variants", orderVariants).Order(fmt.Sprintf("%s %s, id %s", sort, order, order)).Limit(limit + 1).Find(&products).Error; err != nil {
+		return nil, err
 	}
 
-	return &productData, nil
+	result := &ProductPage{Data: make([]ProductData, 0, len(products)), Total: total}
+	if len(products) > limit {
+		products = products[:limit]
+		last := products[limit-1]
+		next := productCursor{Sort: sort, Order: order, Price: last.Price, Name: last.Name, CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+		result.NextCursor = &next
+	}
+	for _, p := range products {
+		result.Data = append(result.Data, productData(p))
+	}
+
+	return result, nil
 }
 
-func GetProductByCode(code string) (*ProductData, error) {
-	db := database.DB
+func (d *Deps) GetProductByCode(code string) (*ProductData, error) {
+	db := d.DB
 	var product models.Product
-	if err := db.Where(&models.Product{Code: strings.ToUpper(code)}).First(&product).Error; err != nil {
+	if err := db.Preload("Categories", orderCategories).Preload("Variants", orderVariants).Where(&models.Product{Code: strings.ToUpper(code)}).First(&product).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, nil
 		}
 		return nil, err
 	}
 
-	productData := ProductData{
-		Code:     product.Code,
-		Name:     product.Name,
-		Price:    product.Price,
-		Weight:   product.Weight,
-		Merchant: product.Merchant,
-	}
+	data := productData(product)
 
-	return &productData, nil
+	return &data, nil
 }
 
 // @Summary Get all products
-// @Description Get all products
+// @Description Search, filter and sort products. Pages are cursor based: pass next_cursor back as cursor with the same sort and order.
 // @Tags Products
 // @Produce json
-// @Success 200 {array} handler.ProductData	"OK"
-// @Failure 404 {object} string "No products found"
+// @Param q query string false "Search product name and code"
+// @Param merchant query string false "Merchant username"
+// @Param category query string false "Category slug, including its subcategories"
+// @Param min_price query string false "Minimum price"
+// @Param max_price query string false "Maximum price"
+// @Param sort query string false "Sort by" Enums(price, name, created_at) default(created_at)
+// @Param order query string false "Sort order" Enums(asc, desc) default(desc)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Success 200 {object} handler.ProductPage	"OK"
+// @Failure 400 {object} string "Invalid query"
 // @Failure 500 {object} string "Failed to get products"
 // @Router /api/products [get]
-func GetAllProducts(c *fiber.Ctx) error {
-	products, err := GetProducts()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get products", "data": err})
+func (h *Catalog) GetAllProducts(c *fiber.Ctx) error {
+	return h.listProducts(c, "")
+}
+
+// listProducts serves a product list from the query string. A non-empty
+// category overrides the category query parameter.
+func (h *Catalog) listProducts(c *fiber.Ctx, category string) error {
+	query := models.ProductQuery{}
+	if err := c.QueryParser(&query); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid query"})
+	}
+	if category != "" {
+		query.Category = category
 	}
 
-	if products == nil || len(*products) == 0 {
-		return c.Status(404).JSON(fiber.Map{"error": "No products found", "data": nil})
+	validate := validator.New()
+	if err := validate.Struct(query); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	products, err := h.GetProducts(query)
+	if errors.Is(err, errInvalidCursor) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+	if errors.Is(err, errInvalidPrice) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid price", "data": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get products", "data": err})
 	}
 
 	return c.Status(200).JSON(products)
@@ -97,10 +290,10 @@ func GetAllProducts(c *fiber.Ctx) error {
 // @Failure 404 {object} string "Invalid product code"
 // @Failure 500 {object} string "Failed to get product"
 // @Router /api/products/{code} [get]
-func GetProduct(c *fiber.Ctx) error {
+func (h *Catalog) GetProduct(c *fiber.Ctx) error {
 	code := c.Params("code")
 
-	product, err := GetProductByCode(code)
+	product, err := h.GetProductByCode(code)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get product", "data": err})
 	}
@@ -116,21 +309,22 @@ func GetProduct(c *fiber.Ctx) error {
 // @Description Create product
 // @Tags Products
 // @Security Bearer
+// @Security ApiKey
 // @Accept json
 // @Produce json
 // @Param body body models.CreateProductValidation true "Product data"
 // @Success 201 {object} handler.ProductData "Product created successfully"
 // @Failure 400 {object} string "Invalid fields"
 // @Failure 401 {object} string "Unauthorized"
+// @Failure 409 {object} string "Product's code already exists"
 // @Failure 500 {object} string "Failed to create product"
 // @Router /api/products [post]
-func CreateProduct(c *fiber.Ctx) error {
-	user := util.CurrentUser(c)
-	if user.Role != models.Merchant {
+func (h *Catalog) CreateProduct(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
-
-	db := database.DB
+	db := h.DB
 	var body models.CreateProductValidation
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
@@ -145,27 +339,32 @@ func CreateProduct(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
 	}
 
-	if err := db.Create(&models.Product{Code: strings.ToUpper(body.Code), Name: body.Name, Price: body.Price, Weight: body.Weight, Merchant: user.Username}).Error; err != nil {
+	product := models.Product{
+		Code:              strings.ToUpper(body.Code),
+		Name:              body.Name,
+		Price:             body.Price,
+		Currency:          models.IDR,
+		Weight:            body.Weight,
+		Merchant:          user.Username,
+		Stock:             body.Stock,
+		LowStockThreshold: body.LowStockThreshold,
+		Subscribable:      body.Subscribable,
+	}
+	if err := db.Create(&product).Error; err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
 			return c.Status(409).JSON(fiber.Map{"error": "Product's code already exists"})
 		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create product", "data": err})
 	}
 
-	response := ProductData{
-		Code:     body.Code,
-		Name:     body.Name,
-		Price:    body.Price,
-		Weight:   body.Weight,
-		Merchant: user.Username,
-	}
-
-	return c.Status(201).JSON(response)
+	return c.Status(201).JSON(productData(product))
 }
 
 // @Summary Update product
 // @Description Update product
 // @Tags Products
 // @Security Bearer
+// @Security ApiKey
 // @Accept json
 // @Produce json
 // @Param code path string true "Product code"
@@ -176,20 +375,20 @@ func CreateProduct(c *fiber.Ctx) error {
 // @Failure 404 {object} string "Invalid product code"
 // @Failure 500 {object} string "Failed to update product"
 // @Router /api/products/{code} [put]
-func UpdateProduct(c *fiber.Ctx) error {
-	user := util.CurrentUser(c)
-	if user.Role != models.Merchant {
+func (h *Catalog) UpdateProduct(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 	code := c.Params("code")
-	db := database.DB
+	db := h.DB
 
-	product, err := GetProductByCode(code)
+	product, err := h.GetProductByCode(code)
 	if err != nil || product == nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Invalid Product Code", "data": err})
 	}
 
-	if product.Merchant != user.Username {
+	if !canWriteProduct(user, product.Merchant) {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
@@ -215,8 +414,9 @@ func UpdateProduct(c *fiber.Ctx) error {
 		Code:     product.Code,
 		Name:     body.Name,
 		Price:    body.Price,
+		Currency: product.Currency,
 		Weight:   body.Weight,
-		Merchant: user.Username,
+		Merchant: product.Merchant,
 	}
 
 	return c.Status(200).JSON(response)
@@ -226,6 +426,7 @@ func UpdateProduct(c *fiber.Ctx) error {
 // @Description Delete product
 // @Tags Products
 // @Security Bearer
+// @Security ApiKey
 // @Accept json
 // @Produce json
 // @Param code path string true "Product code"
@@ -234,24 +435,24 @@ func UpdateProduct(c *fiber.Ctx) error {
 // @Failure 404 {object} string "Invalid product code"
 // @Failure 500 {object} string "Failed to delete product"
 // @Router /api/products/{code} [delete]
-func DeleteProduct(c *fiber.Ctx) error {
-	user := util.CurrentUser(c)
-	if user.Role != models.Merchant {
+func (h *Catalog) DeleteProduct(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 	code := c.Params("code")
-	db := database.DB
+	db := h.DB
 
-	product, err := GetProductByCode(code)
+	product, err := h.GetProductByCode(code)
 	if err != nil || product == nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Invalid Product Code", "data": err})
 	}
 
-	if product.Merchant != user.Username {
+	if !canWriteProduct(user, product.Merchant) {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
-	if err := db.Delete(&product).Error; err != nil {
+	if err := db.Where("code = ?", product.Code).Delete(&models.Product{}).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete product", "data": err})
 	}
 
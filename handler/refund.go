@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errNotRefundable           = errors.New("order cannot be refunded")
+	errSeveralMerchants        = errors.New("purchase has several merchants")
+	errRefundExceeded          = errors.New("refund exceeds refundable amount")
+	errInsufficientMerchantBal = errors.New("insufficient merchant balance")
+)
+
+// refundedAmount sums what merchantAccountID already refunded on purchase.
+func refundedAmount(tx *gorm.DB, purchase *models.Order, merchantAccountID uint) (models.Money, error) {
+	var refunded models.Money
+	err := tx.Model(&models.Order{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("purchase_id = ? AND type = ? AND account_id = ?", purchase.ID, models.Refund, merchantAccountID).
+		Scan(&refunded).Error
+	return refunded, err
+}
+
+// refundMerchant pays amount of purchase back from merchant to the buyer
+// with a pair of REFUND orders and returns the buyer's. Both accounts must
+// be locked by tx.
+func (d *Deps) refundMerchant(tx *gorm.DB, purchase *models.Order, accounts map[string]*models.Account, merchant string, amount models.Money, description string) (*models.Order, error) {
+	buyer := *purchase.Buyer
+	buyerUtil, err := d.GetInvNumber(buyer)
+	if err != nil {
+		return nil, err
+	}
+	merchantUtil, err := d.GetInvNumber(merchant)
+	if err != nil {
+		return nil, err
+	}
+	buyerRefund := models.Order{
+		AccountID:   accounts[buyer].ID,
+		Invoice:     buyerUtil.Invoice,
+		Amount:      amount,
+		Currency:    purchase.Currency,
+		Type:        models.Refund,
+		Status:      models.Completed,
+		PurchaseID:  &purchase.ID,
+		Merchant:    &merchant,
+		Buyer:       &buyer,
+		Description: &description,
+	}
+	merchantRefund := buyerRefund
+	merchantRefund.AccountID = accounts[merchant].ID
+	merchantRefund.Invoice = merchantUtil.Invoice
+	if err := tx.Create(&buyerRefund).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&merchantRefund).Error; err != nil {
+		return nil, err
+	}
+
+	if err := ledger.Post(tx, &models.JournalEntry{
+		Reference:   buyerRefund.Invoice,
+		Description: &description,
+		Postings: []models.Posting{
+			ledger.DebitAccount(accounts[merchant], amount, &merchantRefund.ID),
+			ledger.CreditAccount(accounts[buyer], amount, &buyerRefund.ID),
+		},
+	}); err != nil {
+		return nil, err
+	}
+	return &buyerRefund, nil
+}
+
+// @Summary Refund a payment
+// @Tags Transaction
+// @Description Refund a purchase in full or in part. The merchant's revenue is debited and the buyer credited with paired REFUND entries.
+// @Description Only the merchant or staff may refund, and only staff may override an insufficient merchant balance.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.RefundValidation true "Refund"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Success 201 {object} handler.Refund.RefundResponse
+// @Failure 400 {object} string "Invalid fields or amount exceeds refundable amount"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Order not found"
+// @Failure 409 {object} string "Order cannot be refunded"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 500 {object} string "Failed to refund"
+// @Router /api/transaction/refund [post]
+func (h *Orders) Refund(c *fiber.Ctx) error {
+	type RefundResponse struct {
+		Invoice    string             `json:"invoice"`
+		Purchase   string             `json:"purchase"`
+		Merchant   string             `json:"merchant"`
+		Buyer      string             `json:"buyer"`
+		Amount     models.Money       `json:"amount"`
+		Refundable models.Money       `json:"refundable"`
+		Currency   models.Currency    `json:"currency"`
+		Status     models.OrderStatus `json:"status"`
+		CreatedAt  time.Time          `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.RefundValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	if body.Override && !user.Role.Can(models.RefundOverride) {
+		return c.Status(401).JSON(fiber.Map{"error": "Only staff may override the merchant balance check"})
+	}
+
+	var response RefundResponse
+	err = db.Transaction(func(tx *gorm.DB) error {
+		purchase, err := findPurchase(tx, body.Invoice)
+		if err != nil {
+			return err
+		}
+		// serialize refunds of the same purchase
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(purchase, purchase.ID).Error; err != nil {
+			return err
+		}
+		if !purchase.Status.CanTransition(models.Refunded) || purchase.Buyer == nil {
+			return errNotRefundable
+		}
+
+		var revenues []models.Order
+		if err := tx.Where("purchase_id = ? AND type = ?", purchase.ID, models.Revenue).Find(&revenues).Error; err != nil {
+			return err
+		}
+		var revenue *models.Order
+		for i := range revenues {
+			if revenues[i].Invoice == body.Invoice || len(revenues) == 1 {
+				revenue = &revenues[i]
+			}
+		}
+		if revenue == nil {
+			return errSeveralMerchants
+		}
+
+		merchant, buyer := *revenue.Merchant, *purchase.Buyer
+		if merchant != username && !user.Role.Can(models.OrderManageAny) {
+			return errNotOrderParty
+		}
+		if merchant == buyer {
+			return errNotRefundable
+		}
+
+		accounts, err := lockAccounts(tx, buyer, merchant)
+		if err != nil {
+			return err
+		}
+		if accounts[buyer] == nil {
+			return errAccountNotFound
+		}
+		if accounts[merchant] == nil {
+			return errMerchantNotFound
+		}
+
+		refunded, err := refundedAmount(tx, purchase, revenue.AccountID)
+		if err != nil {
+			return err
+		}
+		refundable := revenue.Amount - refunded
+		amount := refundable
+		if body.Amount != nil {
+			amount = *body.Amount
+		}
+		if amount <= 0 || amount > refundable {
+			return errRefundExceeded
+		}
+		if amount > accounts[merchant].Balance && !body.Override {
+			return errInsufficientMerchantBal
+		}
+
+		description := fmt.Sprintf("Refund for %s", purchase.Invoice)
+		if body.Reason != nil {
+			description = fmt.Sprintf("%s: %s", description, *body.Reason)
+		}
+
+		buyerRefund, err := h.refundMerchant(tx, purchase, accounts, merchant, amount, description)
+		if err != nil {
+			return err
+		}
+
+		if amount == refundable {
+			if err := releaseStock(tx, purchase, merchant, "refunded", username); err != nil {
+				return err
+			}
+		}
+
+		// the purchase is REFUNDED once every merchant paid everything back
+		var totalRefunded models.Money
+		if err := tx.Model(&models.Order{}).
+			Select("COALESCE(SUM(amount), 0)").
+			Where("purchase_id = ? AND type = ? AND account_id <> ?", purchase.ID, models.Refund, purchase.AccountID).
+			Scan(&totalRefunded).Error; err != nil {
+			return err
+		}
+		if totalRefunded >= purchase.Amount {
+			if err := transitionOrder(tx, purchase, models.Refunded, username, body.Reason); err != nil {
+				return err
+			}
+		}
+
+		response = RefundResponse{
+			Invoice:    buyerRefund.Invoice,
+			Purchase:   purchase.Invoice,
+			Merchant:   merchant,
+			Buyer:      buyer,
+			Amount:     amount,
+			Refundable: refundable - amount,
+			Currency:   purchase.Currency,
+			Status:     purchase.Status,
+			CreatedAt:  buyerRefund.CreatedAt,
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+	case errors.Is(err, errNoLifecycle), errors.Is(err, errNotRefundable):
+		return c.Status(409).JSON(fiber.Map{"error": "Order cannot be refunded"})
+	case errors.Is(err, errSeveralMerchants):
+		return c.Status(400).JSON(fiber.Map{"error": "Purchase has several merchants, refund each merchant invoice"})
+	case errors.Is(err, errNotOrderParty):
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	case errors.Is(err, errRefundExceeded):
+		return c.Status(400).JSON(fiber.Map{"error": "Refund exceeds refundable amount"})
+	case errors.Is(err, errInsufficientMerchantBal):
+		return c.Status(400).JSON(fiber.Map{"error": "Insufficient merchant balance"})
+	case errors.Is(err, errAccountNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	case errors.Is(err, errMerchantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Merchant not found"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to refund", "data": err})
+	}
+
+	return c.Status(201).JSON(fiber.Map{"data": response})
+}
@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errOrderNotFound     = errors.New("order not found")
+	errNoLifecycle       = errors.New("order has no lifecycle")
+	errIllegalTransition = errors.New("illegal status transition")
+	errNotOrderParty     = errors.New("not a party to the order")
+)
+
+// findPurchase resolves invoice to the PAYMENT order it belongs to, so a
+// merchant may address a purchase by the invoice of its REVENUE order.
+func findPurchase(db *gorm.DB, invoice string) (*models.Order, error) {
+	var order models.Order
+	if err := db.Where(&models.Order{Invoice: invoice}).First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errOrderNotFound
+		}
+		return nil, err
+	}
+
+	switch order.Type {
+	case models.Payment:
+		return &order, nil
+	case models.Revenue:
+		if order.PurchaseID == nil {
+			return nil, errNoLifecycle
+		}
+		var purchase models.Order
+		if err := db.First(&purchase, *order.PurchaseID).Error; err != nil {
+			return nil, err
+		}
+		return &purchase, nil
+	default:
+		return nil, errNoLifecycle
+	}
+}
+
+// purchaseMerchants returns the merchants paid by purchase.
+func purchaseMerchants(db *gorm.DB, purchase *models.Order) ([]string, error) {
+	var merchants []string
+	err := db.Model(&models.Order{}).
+		Where("purchase_id = ? AND type = ?", purchase.ID, models.Revenue).
+		Distinct().Pluck("merchant", &merchants).Error
+	return merchants, err
+}
+
+// transitionOrder moves purchase and its REVENUE orders to next and appends
+// the change to the status history. purchase must be locked by tx.
+func transitionOrder(tx *gorm.DB, purchase *models.Order, next models.OrderStatus, actor string, note *string) error {
+	if !purchase.Status.CanTransition(next) {
+		return fmt.Errorf("%w: %s to %s", errIllegalTransition, purchase.Status, next)
+	}
+
+	if err := tx.Model(&models.Order{}).
+		Where("id = ? OR (purchase_id = ? AND type = ?)", purchase.ID, purchase.ID, models.Revenue).
+		Update("status", next).Error; err != nil {
+		return err
+	}
+
+	from := purchase.Status
+	purchase.Status = next
+	return tx.Create(&models.OrderStatusHistory{
+		OrderID:    purchase.ID,
+		FromStatus: &from,
+		ToStatus:   next,
+		Actor:      actor,
+		Note:       note,
+	}).Error
+}
+
+// cancelOrder cancels purchase: every merchant pays back what it has not
+// refunded yet and puts the items it has not released back in stock. A
+// merchant short of the money blocks the cancellation; staff can still
+// refund with an override. purchase must be locked by tx.
+func (d *Deps) cancelOrder(tx *gorm.DB, purchase *models.Order, actor string, note *string) error {
+	if !purchase.Status.CanTransition(models.Cancelled) {
+		return fmt.Errorf("%w: %s to %s", errIllegalTransition, purchase.Status, models.Cancelled)
+	}
+	// the biller has been paid and does not give it back
+	if purchase.BillerReference != nil || purchase.Buyer == nil {
+		return fmt.Errorf("%w: bill payments cannot be cancelled", errIllegalTransition)
+	}
+	buyer := *purchase.Buyer
+
+	var revenues []models.Order
+	if err := tx.Where("purchase_id = ? AND type = ?", purchase.ID, models.Revenue).Order("id").Find(&revenues).Error; err != nil {
+		return err
+	}
+	owners := []string{buyer}
+	for _, revenue := range revenues {
+		owners = append(owners, *revenue.Merchant)
+	}
+	accounts, err := lockAccounts(tx, owners...)
+	if err != nil {
+		return err
+	}
+	if accounts[buyer] == nil {
+		return errAccountNotFound
+	}
+
+	description := fmt.Sprintf("Cancellation of %s", purchase.Invoice)
+	if note != nil {
+		description = fmt.Sprintf("%s: %s", description, *note)
+	}
+	for _, revenue := range revenues {
+		merchant := *revenue.Merchant
+		refunded, err := refundedAmount(tx, purchase, revenue.AccountID)
+		if err != nil {
+			return err
+		}
+		refundable := revenue.Amount - refunded
+		// refunded in full, which released its items already
+		if refundable <= 0 {
+			continue
+		}
+
+		// buying from oneself moved no money
+		if merchant != buyer {
+			if accounts[merchant] == nil {
+				return errMerchantNotFound
+			}
+			if refundable > accounts[merchant].Balance {
+				return errInsufficientMerchantBal
+			}
+			if _, err := d.refundMerchant(tx, purchase, accounts, merchant, refundable, description); err != nil {
+				return err
+			}
+		}
+		if err := releaseStock(tx, purchase, merchant, "cancelled", actor); err != nil {
+			return err
+		}
+	}
+
+	return transitionOrder(tx, purchase, models.Cancelled, actor, note)
+}
+
+// @Summary Get order
+// @Tags Orders
+// @Description Get a purchase with its items and status history, by the buyer's or a merchant's invoice
+// @Security Bearer
+// @Security ApiKey
+// @Produce json
+// @Param invoice path string true "Invoice"
+// @Success 200 {object} handler.GetOrder.OrderDetailResponse
+// @Failure 400 {object} string "Order has no lifecycle"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Order not found"
+// @Failure 500 {object} string "Failed to get order"
+// @Router /api/orders/{invoice} [get]
+func (h *Orders) GetOrder(c *fiber.Ctx) error {
+	type OrderDetailResponse struct {
+		Invoice   string                      `json:"invoice"`
+		Buyer     *string                     `json:"buyer"`
+		Merchants []string                    `json:"merchants"`
+		Amount    models.Money                `json:"amount"`
+		Currency  models.Currency             `json:"currency"`
+		Status    models.OrderStatus          `json:"status"`
+		Items     []OrderItemData             `json:"items"`
+		History   []models.OrderStatusHistory `json:"history"`
+		// BillerReference and BillerToken are set for bill payments.
+		BillerReference *string   `json:"biller_reference"`
+		BillerToken     *string   `json:"biller_token"`
+		CreatedAt       time.Time `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	purchase, err := findPurchase(db, c.Params("invoice"))
+	if errors.Is(err, errOrderNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+	}
+	if errors.Is(err, errNoLifecycle) {
+		return c.Status(400).JSON(fiber.Map{"error": "Order has no lifecycle"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get order", "data": err})
+	}
+
+	merchants, err := purchaseMerchants(db, purchase)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get order", "data": err})
+	}
+	if !isOrderParty(purchase, merchants, username) && !user.Role.Can(models.OrderManageAny) {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var items []models.OrderItem
+	if err := db.Where("order_id = ?", purchase.ID).Order("id").Find(&items).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get order", "data": err})
+	}
+	var history []models.OrderStatusHistory
+	if err := db.Where("order_id = ?", purchase.ID).Order("id").Find(&history).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get order", "data": err})
+	}
+
+	return c.Status(200).JSON(OrderDetailResponse{
+		Invoice:         purchase.Invoice,
+		Buyer:           purchase.Buyer,
+		Merchants:       merchants,
+		Amount:          purchase.Amount,
+		Currency:        purchase.Currency,
+		Status:          purchase.Status,
+		Items:           orderItemData(items),
+		History:         history,
+		BillerReference: purchase.BillerReference,
+		BillerToken:     purchase.BillerToken,
+		CreatedAt:       purchase.CreatedAt,
+	})
+}
+
+func isOrderParty(purchase *models.Order, merchants []string, username string) bool {
+	return (purchase.Buyer != nil && *purchase.Buyer == username) || slices.Contains(merchants, username)
+}
+
+// @Summary Update order status
+// @Tags Orders
+// @Description Merchants mark a paid order FULFILLED, buyers confirm a fulfilled order COMPLETED. Either party may cancel a PAID order before it is fulfilled, which refunds the buyer what was not refunded yet and puts the items back in stock. A merchant may only change an order it is the sole merchant of; on an order from several merchants each refunds its own share instead.
+// @Security Bearer
+// @Security ApiKey
+// @Accept json
+// @Produce json
+// @Param invoice path string true "Invoice"
+// @Param body body models.UpdateOrderStatusValidation true "Status"
+// @Success 200 {object} handler.UpdateOrderStatus.StatusResponse
+// @Failure 400 {object} string "Invalid fields, or insufficient merchant balance to cancel"
+// @Failure 401 {object} string "Unauthorized, or the order has other merchants"
+// @Failure 404 {object} string "Order not found"
+// @Failure 409 {object} string "Illegal status transition"
+// @Failure 500 {object} string "Failed to update order status"
+// @Router /api/orders/{invoice}/status [patch]
+func (h *Orders) UpdateOrderStatus(c *fiber.Ctx) error {
+	type StatusResponse struct {
+		Invoice string             `json:"invoice"`
+		Status  models.OrderStatus `json:"status"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.UpdateOrderStatusValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var purchase *models.Order
+	err = db.Transaction(func(tx *gorm.DB) error {
+		found, err := findPurchase(tx, c.Params("invoice"))
+		if err != nil {
+			return err
+		}
+		purchase = found
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(purchase, purchase.ID).Error; err != nil {
+			return err
+		}
+
+		merchants, err := purchaseMerchants(tx, purchase)
+		if err != nil {
+			return err
+		}
+		isBuyer := purchase.Buyer != nil && *purchase.Buyer == username
+		// staff act for the merchant. A merchant only speaks for an order
+		// it is the sole merchant of, so it cannot fulfil or cancel, and
+		// refund, the share of another
+		isMerchant := user.Role.Can(models.OrderManageAny) ||
+			(len(merchants) == 1 && merchants[0] == username)
+
+		switch body.Status {
+		case models.Fulfilled:
+			if !isMerchant {
+				return errNotOrderParty
+			}
+		case models.Completed:
+			if !isBuyer {
+				return errNotOrderParty
+			}
+		case models.Cancelled:
+			if !isBuyer && !isMerchant {
+				return errNotOrderParty
+			}
+		}
+
+		if body.Status == models.Cancelled {
+			return h.cancelOrder(tx, purchase, username, body.Note)
+		}
+		return transitionOrder(tx, purchase, body.Status, username, body.Note)
+	})
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+	case errors.Is(err, errNoLifecycle):
+		return c.Status(400).JSON(fiber.Map{"error": "Order has no lifecycle"})
+	case errors.Is(err, errNotOrderParty):
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	case errors.Is(err, errIllegalTransition):
+		return c.Status(409).JSON(fiber.Map{"error": "Illegal status transition", "data": err.Error()})
+	case errors.Is(err, errInsufficientMerchantBal):
+		return c.Status(400).JSON(fiber.Map{"error": "Insufficient merchant balance"})
+	case errors.Is(err, errAccountNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	case errors.Is(err, errMerchantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Merchant not found"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update order status", "data": err})
+	}
+
+	return c.Status(200).JSON(StatusResponse{Invoice: purchase.Invoice, Status: purchase.Status})
+}
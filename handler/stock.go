@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errInsufficientStock = errors.New("insufficient stock")
+	errProductNotFound   = errors.New("product not found")
+)
+
+// stockKey is a stock-keeping unit: a product, or one variant of it.
+type stockKey struct {
+	Code string
+	SKU  string
+}
+
+func (k stockKey) String() string {
+	if k.SKU != "" {
+		return k.SKU
+	}
+	return k.Code
+}
+
+// changeStock adds delta to the stock of a tracked product, or of its variant
+// with sku, and records the movement. Stock that is not tracked is left
+// alone, and a change that would take stock below zero fails with
+// errInsufficientStock.
+func changeStock(tx *gorm.DB, key stockKey, delta int, reason, actor string, orderID *uint, note *string) error {
+	// the updated stock is returned into the model
+	var product models.Product
+	var variant models.ProductVariant
+	query, stock := tx.Model(&product).Where("code = ?", key.Code), &product.Stock
+	// SKUs are reused after a variant is deleted, so the variant is looked
+	// up under its product, never by SKU alone
+	if key.SKU != "" {
+		query, stock = tx.Model(&variant).
+			Where("product_id = (SELECT id FROM products WHERE code = ?) AND sku = ?", key.Code, key.SKU), &variant.Stock
+	}
+	res := query.
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "stock"}}}).
+		Where("(stock IS NULL OR stock + ? >= 0)", delta).
+		Update("stock", gorm.Expr("stock + ?", delta))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s", errInsufficientStock, key)
+	}
+	if *stock == nil {
+		return nil
+	}
+
+	var sku *string
+	if key.SKU != "" {
+		sku = &key.SKU
+	}
+	return tx.Create(&models.StockMovement{
+		ProductCode: key.Code,
+		VariantSKU:  sku,
+		Delta:       delta,
+		StockAfter:  **stock,
+		Reason:      reason,
+		Actor:       actor,
+		OrderID:     orderID,
+		Note:        note,
+	}).Error
+}
+
+// reserveStock takes the items of order out of stock. Stock is updated in
+// code and SKU order so concurrent orders cannot deadlock.
+func reserveStock(tx *gorm.DB, order *models.Order, actor string) error {
+	qty := make(map[stockKey]int)
+	keys := make([]stockKey, 0)
+	for _, item := range order.Items {
+		key := itemStockKey(item)
+		if _, ok := qty[key]; !ok {
+			keys = append(keys, key)
+		}
+		qty[key] += item.Qty
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Code != keys[j].Code {
+			return keys[i].Code < keys[j].Code
+		}
+		return keys[i].SKU < keys[j].SKU
+	})
+
+	for _, key := range keys {
+		if err := changeStock(tx, key, -qty[key], "sale", actor, &order.ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseStock puts the items of a cancelled or refunded purchase back in
+// stock. With merchant set only that merchant's items are released.
+func releaseStock(tx *gorm.DB, purchase *models.Order, merchant, reason, actor string) error {
+	query := tx.Where("order_id = ?", purchase.ID)
+	if merchant != "" {
+		query = query.Where("merchant = ?", merchant)
+	}
+	var items []models.OrderItem
+	if err := query.Order("product_code, variant_sku").Find(&items).Error; err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		err := changeStock(tx, itemStockKey(item), item.Qty, reason, actor, &purchase.ID, nil)
+		// a product deleted since the sale has no stock to return to
+		if err != nil && !errors.Is(err, errInsufficientStock) {
+			return err
+		}
+	}
+	return nil
+}
+
+func itemStockKey(item models.OrderItem) stockKey {
+	key := stockKey{Code: item.ProductCode}
+	if item.VariantSKU != nil {
+		key.SKU = *item.VariantSKU
+	}
+	return key
+}
+
+// @Summary Adjust product stock
+// @Description Add or remove stock of a product, or of one of its variants by SKU, with a reason. Stock that is not tracked starts tracking from zero.
+// @Tags Products
+// @Security Bearer
+// @Security ApiKey
+// @Accept json
+// @Produce json
+// @Param code path string true "Product code"
+// @Param body body models.AdjustStockValidation true "Adjustment"
+// @Success 200 {object} handler.ProductData "Stock adjusted"
+// @Failure 400 {object} string "Invalid fields"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Invalid product code or variant"
+// @Failure 409 {object} string "Insufficient stock"
+// @Failure 500 {object} string "Failed to adjust stock"
+// @Router /api/product/{code}/stock [post]
+func (h *Catalog) AdjustStock(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	code := c.Params("code")
+	db := h.DB
+
+	body := &models.AdjustStockValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var product models.Product
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where("code = ?", strings.ToUpper(code)).First(&product).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errProductNotFound
+			}
+			return err
+		}
+		if !canWriteProduct(user, product.Merchant) {
+			return errNotOrderParty
+		}
+
+		key := stockKey{Code: product.Code, SKU: strings.ToUpper(body.SKU)}
+		updates := map[string]interface{}{}
+		if key.SKU != "" {
+			var variant models.ProductVariant
+			if err := tx.Where("product_id = ? AND sku = ?", product.ID, key.SKU).First(&variant).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return errVariantNotFound
+				}
+				return err
+			}
+			if variant.Stock == nil {
+				if err := tx.Model(&variant).Update("stock", 0).Error; err != nil {
+					return err
+				}
+			}
+		} else if product.Stock == nil {
+			updates["stock"] = 0
+		}
+		if body.LowStockThreshold != nil {
+			updates["low_stock_threshold"] = *body.LowStockThreshold
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&product).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := changeStock(tx, key, body.Delta, body.Reason, username, nil, body.Note); err != nil {
+			return err
+		}
+
+		return tx.Preload("Categories", orderCategories).Preload("Variants", orderVariants).First(&product, product.ID).Error
+	})
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Invalid Product Code"})
+	case errors.Is(err, errVariantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Variant not found"})
+	case errors.Is(err, errNotOrderParty):
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	case errors.Is(err, errInsufficientStock):
+		return c.Status(409).JSON(fiber.Map{"error": "Insufficient stock"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to adjust stock", "data": err})
+	}
+
+	return c.Status(200).JSON(productData(product))
+}
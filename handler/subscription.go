@@ -0,0 +1,583 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/biller"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errNotSubscribable         = errors.New("product is not subscribable")
+	errCustomerNumberRequired  = errors.New("customer number required")
+	errSubscriptionNotFound    = errors.New("subscription not found")
+	errIllegalSubscriptionMove = errors.New("illegal subscription status change")
+)
+
+type SubscriptionData struct {
+	ID             uint                      `json:"id"`
+	Code           string                    `json:"code"`
+	SKU            *string                   `json:"sku"`
+	Interval       models.BillingInterval    `json:"interval"`
+	CustomerNumber *string                   `json:"customer_number"`
+	Status         models.SubscriptionStatus `json:"status"`
+	NextChargeAt   *time.Time                `json:"next_charge_at"`
+	RetryAt        *time.Time                `json:"retry_at"`
+	FailedAttempts int                       `json:"failed_attempts"`
+	LastError      *string                   `json:"last_error"`
+	CreatedAt      time.Time                 `json:"created_at"`
+	CancelledAt    *time.Time                `json:"cancelled_at"`
+}
+
+func subscriptionData(sub *models.Subscription) SubscriptionData {
+	data := SubscriptionData{
+		ID:             sub.ID,
+		Code:           sub.ProductCode,
+		SKU:            sub.VariantSKU,
+		Interval:       sub.Interval,
+		CustomerNumber: sub.CustomerNumber,
+		Status:         sub.Status,
+		RetryAt:        sub.RetryAt,
+		FailedAttempts: sub.FailedAttempts,
+		LastError:      sub.LastError,
+		CreatedAt:      sub.CreatedAt,
+		CancelledAt:    sub.CancelledAt,
+	}
+	if sub.Status != models.SubscriptionCancelled {
+		data.NextChargeAt = &sub.NextChargeAt
+	}
+	return data
+}
+
+// subscriptionPlan checks that code, or the variant sku, may be subscribed
+// to and returns the product with the price of a period. Bill products need
+// the customer to charge, and have no price until the biller is asked.
+func (h *Billing) subscriptionPlan(code, sku string, customerNumber *string) (*ProductData, *string, *models.Money, error) {
+	line, err := h.resolveLine(code, sku, 1)
+	if errors.Is(err, errBillProduct) {
+		product, err := h.GetProductByCode(code)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !product.Subscribable {
+			return nil, nil, nil, errNotSubscribable
+		}
+		if customerNumber == nil {
+			return nil, nil, nil, errCustomerNumberRequired
+		}
+		return product, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !line.Product.Subscribable {
+		return nil, nil, nil, errNotSubscribable
+	}
+	price := line.unitPrice()
+	return line.Product, line.sku(), &price, nil
+}
+
+// chargeSubscription charges one period of sub inside tx and returns the
+// PAYMENT order. Bill products are charged what the biller reports due, and
+// nothing when the bill is already paid, in which case the order is nil.
+func (h *Billing) chargeSubscription(ctx context.Context, tx *gorm.DB, sub *models.Subscription) (*models.Order, error) {
+	product, err := h.GetProductByCode(sub.ProductCode)
+	if err != nil {
+		return nil, err
+	}
+	if product == nil {
+		return nil, errProductNotFound
+	}
+
+	var order *models.Order
+	if product.Biller != nil {
+		if sub.CustomerNumber == nil {
+			return nil, errCustomerNumberRequired
+		}
+		b, err := h.Billers.Get(*product.Biller)
+		if err != nil {
+			return nil, err
+		}
+		bill, err := b.Inquire(ctx, product.Code, *sub.CustomerNumber)
+		if errors.Is(err, biller.ErrAlreadyPaid) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// one biller reference per period, so a retried charge is not paid twice
+		reference := fmt.Sprintf("SUB-%d-%s", sub.ID, sub.NextChargeAt.Format("20060102"))
+		if order, _, err = h.payBill(ctx, tx, sub.Owner, product, *bill, reference); err != nil {
+			return nil, err
+		}
+	} else {
+		sku := ""
+		if sub.VariantSKU != nil {
+			sku = *sub.VariantSKU
+		}
+		line, err := h.resolveLine(sub.ProductCode, sku, 1)
+		if err != nil {
+			return nil, err
+		}
+		if order, err = h.placeOrder(tx, sub.Owner, []orderLine{*line}); err != nil {
+			return nil, err
+		}
+	}
+
+	order.SubscriptionID = &sub.ID
+	if err := tx.Model(order).Update("subscription_id", sub.ID).Error; err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// runCharge charges sub and records the attempt. A failed charge is retried
+// after the next retry delay, and cancels the subscription once retries run
+// out. sub must be locked by tx. The returned error is the charge failure,
+// already recorded on sub.
+func (h *Billing) runCharge(ctx context.Context, tx *gorm.DB, sub *models.Subscription, now time.Time) error {
+	var order *models.Order
+	// a savepoint, so a failed charge leaves nothing behind but its record
+	chargeErr := tx.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = h.chargeSubscription(ctx, tx, sub)
+		return err
+	})
+
+	charge := models.SubscriptionCharge{SubscriptionID: sub.ID, Attempt: sub.FailedAttempts + 1}
+	if chargeErr != nil {
+		msg := chargeErr.Error()
+		charge.Error = &msg
+		sub.LastError = &msg
+		sub.FailedAttempts++
+
+		delays := h.Config.Billing.RetryDelays
+		if sub.FailedAttempts > len(delays) {
+			sub.Status, sub.CancelledAt, sub.RetryAt = models.SubscriptionCancelled, &now, nil
+		} else {
+			retryAt := now.Add(delays[sub.FailedAttempts-1])
+			sub.Status, sub.RetryAt = models.SubscriptionPastDue, &retryAt
+		}
+	} else {
+		if order != nil {
+			charge.OrderID, charge.Amount = &order.ID, &order.Amount
+		}
+		sub.Status, sub.FailedAttempts, sub.RetryAt, sub.LastError = models.SubscriptionActive, 0, nil, nil
+		// periods missed while the scheduler was down are skipped, not charged
+		for !sub.NextChargeAt.After(now) {
+			sub.NextChargeAt = sub.Interval.Next(sub.NextChargeAt, sub.AnchorAt)
+		}
+	}
+
+	if err := tx.Create(&charge).Error; err != nil {
+		return err
+	}
+	if err := tx.Save(sub).Error; err != nil {
+		return err
+	}
+	return chargeErr
+}
+
+// chargeDueSubscriptions charges every subscription due at now. Each is
+// charged in its own transaction and skipped while another instance holds
+// it, so several schedulers may run at once.
+func (h *Billing) chargeDueSubscriptions(ctx context.Context, now time.Time) {
+	db := h.DB
+	due := func(db *gorm.DB) *gorm.DB {
+		return db.Where("status IN ? AND COALESCE(retry_at, next_charge_at) <= ?",
+			[]models.SubscriptionStatus{models.SubscriptionActive, models.SubscriptionPastDue}, now)
+	}
+
+	var ids []uint
+	if err := db.Model(&models.Subscription{}).Scopes(due).Order("id").Limit(100).Pluck("id", &ids).Error; err != nil {
+		h.Logger.Printf("subscriptions: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var sub models.Subscription
+			res := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+				Scopes(due).Limit(1).Find(&sub, id)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+
+			if err := h.runCharge(ctx, tx, &sub, now); err != nil {
+				h.Logger.Printf("subscriptions: charge of subscription %d failed (attempt %d): %v", sub.ID, sub.FailedAttempts, err)
+			}
+			return nil
+		})
+		if err != nil {
+			h.Logger.Printf("subscriptions: subscription %d: %v", id, err)
+		}
+	}
+}
+
+// RunSubscriptions charges due subscriptions every subscription tick of the
+// configuration, until ctx is done.
+func (h *Billing) RunSubscriptions(ctx context.Context) {
+	ticker := time.NewTicker(h.Config.Billing.SubscriptionTick)
+	defer ticker.Stop()
+	for {
+		h.chargeDueSubscriptions(ctx, h.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func subscriptionError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errSubscriptionNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Subscription not found"})
+	case errors.Is(err, errIllegalSubscriptionMove):
+		return c.Status(409).JSON(fiber.Map{"error": "Illegal subscription status change", "data": err.Error()})
+	case errors.Is(err, errNotSubscribable):
+		return c.Status(400).JSON(fiber.Map{"error": "Product is not subscribable"})
+	case errors.Is(err, errCustomerNumberRequired):
+		return c.Status(400).JSON(fiber.Map{"error": "Customer number required for bill products"})
+	default:
+		return billError(c, err)
+	}
+}
+
+// lockSubscription loads the subscription with the id in the path for an
+// update by its owner.
+func lockSubscription(tx *gorm.DB, c *fiber.Ctx, owner string) (*models.Subscription, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, errSubscriptionNotFound
+	}
+	var sub models.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where("id = ? AND owner = ?", id, owner).First(&sub).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errSubscriptionNotFound
+		}
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// @Summary Subscribe
+// @Tags Subscription
+// @Description Subscribe to a product, or a variant by SKU, charging the first period right away. Bill products need the biller's customer number and are charged what is due each period.
+// @Description Users with two-factor authentication send a code in X-2FA-Code for a price from STEP_UP_THRESHOLD, and for every bill product.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.SubscribeValidation true "Subscription"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Param X-2FA-Code header string false "Two-factor code, for prices from STEP_UP_THRESHOLD and bills"
+// @Success 201 {object} handler.SubscriptionData
+// @Failure 400 {object} string "Invalid fields, product not subscribable or insufficient balance"
+// @Failure 401 {object} string "Unauthorized, or two-factor code missing or invalid"
+// @Failure 404 {object} string "Product not found"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 429 {object} string "Too many invalid two-factor codes"
+// @Failure 502 {object} string "Biller unavailable"
+// @Failure 500 {object} string "Failed to purchase"
+// @Router /api/subscription [post]
+func (h *Billing) Subscribe(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.SubscribeValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	product, sku, price, err := h.subscriptionPlan(body.Code, body.SKU, body.CustomerNumber)
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+	// what a bill charges is only known once the biller is asked, which
+	// pays it too, so subscribing to a bill always takes the second factor
+	amount := h.Config.Limits.StepUpThreshold
+	if price != nil {
+		amount = *price
+	}
+	if err := h.requireStepUp(c, username, amount); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	now := h.Now()
+	sub := models.Subscription{
+		Owner:          username,
+		ProductCode:    product.Code,
+		VariantSKU:     sku,
+		Interval:       body.Interval,
+		CustomerNumber: body.CustomerNumber,
+		Status:         models.SubscriptionActive,
+		AnchorAt:       now,
+		NextChargeAt:   now,
+	}
+	// a first charge that fails leaves no subscription behind
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&sub).Error; err != nil {
+			return err
+		}
+		order, err := h.chargeSubscription(c.UserContext(), tx, &sub)
+		if err != nil {
+			return err
+		}
+
+		charge := models.SubscriptionCharge{SubscriptionID: sub.ID, Attempt: 1}
+		if order != nil {
+			charge.OrderID, charge.Amount = &order.ID, &order.Amount
+		}
+		if err := tx.Create(&charge).Error; err != nil {
+			return err
+		}
+		sub.NextChargeAt = sub.Interval.Next(now, sub.AnchorAt)
+		return tx.Model(&sub).Update("next_charge_at", sub.NextChargeAt).Error
+	})
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+
+	return c.Status(201).JSON(subscriptionData(&sub))
+}
+
+// @Summary Get subscriptions
+// @Tags Subscription
+// @Description Get user's subscriptions
+// @Security Bearer
+// @Produce json
+// @Success 200 {array} handler.SubscriptionData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 500 {object} string "Failed to get subscriptions"
+// @Router /api/subscription [get]
+func (h *Billing) GetSubscriptions(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	var subs []models.Subscription
+	if err := db.Where("owner = ?", username).Order("id").Find(&subs).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get subscriptions", "data": err})
+	}
+
+	data := make([]SubscriptionData, len(subs))
+	for i := range subs {
+		data[i] = subscriptionData(&subs[i])
+	}
+	return c.Status(200).JSON(data)
+}
+
+// @Summary Get subscription
+// @Tags Subscription
+// @Description Get a subscription with its charge attempts
+// @Security Bearer
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Success 200 {object} handler.GetSubscription.SubscriptionDetailResponse
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Subscription not found"
+// @Failure 500 {object} string "Failed to get subscription"
+// @Router /api/subscription/{id} [get]
+func (h *Billing) GetSubscription(c *fiber.Ctx) error {
+	type SubscriptionDetailResponse struct {
+		SubscriptionData
+		Charges []models.SubscriptionCharge `json:"charges"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	var sub models.Subscription
+	if err := db.Where("id = ? AND owner = ?", c.Params("id"), username).First(&sub).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Subscription not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get subscription", "data": err})
+	}
+
+	var charges []models.SubscriptionCharge
+	if err := db.Where("subscription_id = ?", sub.ID).Order("id").Find(&charges).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get subscription", "data": err})
+	}
+
+	return c.Status(200).JSON(SubscriptionDetailResponse{SubscriptionData: subscriptionData(&sub), Charges: charges})
+}
+
+// updateSubscription applies change to the caller's subscription in the
+// path and responds with the result.
+func (h *Billing) updateSubscription(c *fiber.Ctx, change func(tx *gorm.DB, sub *models.Subscription) error) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	var sub *models.Subscription
+	err = db.Transaction(func(tx *gorm.DB) error {
+		found, err := lockSubscription(tx, c, username)
+		if err != nil {
+			return err
+		}
+		sub = found
+		if err := change(tx, sub); err != nil {
+			return err
+		}
+		return tx.Save(sub).Error
+	})
+	if err != nil {
+		return subscriptionError(c, err)
+	}
+
+	return c.Status(200).JSON(subscriptionData(sub))
+}
+
+// @Summary Cancel subscription
+// @Tags Subscription
+// @Description Cancel a subscription. Nothing more is charged.
+// @Security Bearer
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Success 200 {object} handler.SubscriptionData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Subscription not found"
+// @Failure 409 {object} string "Subscription already cancelled"
+// @Failure 500 {object} string "Failed to update subscription"
+// @Router /api/subscription/{id}/cancel [post]
+func (h *Billing) CancelSubscription(c *fiber.Ctx) error {
+	return h.updateSubscription(c, func(tx *gorm.DB, sub *models.Subscription) error {
+		if sub.Status == models.SubscriptionCancelled {
+			return fmt.Errorf("%w: %s to %s", errIllegalSubscriptionMove, sub.Status, models.SubscriptionCancelled)
+		}
+		now := h.Now()
+		sub.Status, sub.CancelledAt, sub.RetryAt = models.SubscriptionCancelled, &now, nil
+		return nil
+	})
+}
+
+// @Summary Pause subscription
+// @Tags Subscription
+// @Description Stop charging a subscription until it is resumed. A failed charge being retried is dropped.
+// @Security Bearer
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Success 200 {object} handler.SubscriptionData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Subscription not found"
+// @Failure 409 {object} string "Illegal subscription status change"
+// @Failure 500 {object} string "Failed to update subscription"
+// @Router /api/subscription/{id}/pause [post]
+func (h *Billing) PauseSubscription(c *fiber.Ctx) error {
+	return h.updateSubscription(c, func(tx *gorm.DB, sub *models.Subscription) error {
+		if sub.Status != models.SubscriptionActive && sub.Status != models.SubscriptionPastDue {
+			return fmt.Errorf("%w: %s to %s", errIllegalSubscriptionMove, sub.Status, models.SubscriptionPaused)
+		}
+		sub.Status, sub.RetryAt, sub.FailedAttempts = models.SubscriptionPaused, nil, 0
+		return nil
+	})
+}
+
+// @Summary Resume subscription
+// @Tags Subscription
+// @Description Resume a paused subscription. A charge that fell due while paused is made on the scheduler's next run.
+// @Security Bearer
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Success 200 {object} handler.SubscriptionData
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Subscription not found"
+// @Failure 409 {object} string "Illegal subscription status change"
+// @Failure 500 {object} string "Failed to update subscription"
+// @Router /api/subscription/{id}/resume [post]
+func (h *Billing) ResumeSubscription(c *fiber.Ctx) error {
+	return h.updateSubscription(c, func(tx *gorm.DB, sub *models.Subscription) error {
+		if sub.Status != models.SubscriptionPaused {
+			return fmt.Errorf("%w: %s to %s", errIllegalSubscriptionMove, sub.Status, models.SubscriptionActive)
+		}
+		sub.Status = models.SubscriptionActive
+		if now := h.Now(); sub.NextChargeAt.Before(now) {
+			sub.NextChargeAt = now
+		}
+		return nil
+	})
+}
+
+// @Summary Change subscription plan
+// @Tags Subscription
+// @Description Switch a subscription to another product, variant or interval. The new plan is charged from the next charge on, without proration.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Param body body models.ChangePlanValidation true "Plan"
+// @Success 200 {object} handler.SubscriptionData
+// @Failure 400 {object} string "Invalid fields or product not subscribable"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Subscription or product not found"
+// @Failure 409 {object} string "Subscription cancelled"
+// @Failure 500 {object} string "Failed to update subscription"
+// @Router /api/subscription/{id}/plan [put]
+func (h *Billing) ChangeSubscriptionPlan(c *fiber.Ctx) error {
+	body := &models.ChangePlanValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	return h.updateSubscription(c, func(tx *gorm.DB, sub *models.Subscription) error {
+		if sub.Status == models.SubscriptionCancelled {
+			return fmt.Errorf("%w: subscription is %s", errIllegalSubscriptionMove, sub.Status)
+		}
+		product, sku, _, err := h.subscriptionPlan(body.Code, body.SKU, sub.CustomerNumber)
+		if err != nil {
+			return err
+		}
+		if product.Code != sub.ProductCode && product.Biller != nil {
+			// a new biller does not know the old customer number
+			return errCustomerNumberRequired
+		}
+
+		sub.ProductCode, sub.VariantSKU = product.Code, sku
+		if body.Interval != sub.Interval {
+			sub.Interval, sub.AnchorAt = body.Interval, sub.NextChargeAt
+		}
+		return nil
+	})
+}
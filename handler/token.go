@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// issueTokens signs an access token for user and creates the refresh token
+// that renews it, in family or a new family when family is empty.
+func (h *Auth) issueTokens(tx *gorm.DB, user *models.User, family string) (*tokenPair, error) {
+	now := h.Now()
+	jti := uuid.NewString()
+	expiresAt := now.Add(h.Config.JWT.AccessTokenTTL)
+
+	access, err := h.Keys.Sign(util.NewClaims(h.Config.JWT, user, jti, now, expiresAt))
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+
+	if family == "" {
+		family = uuid.NewString()
+	}
+	if err := tx.Create(&models.RefreshToken{
+		Owner:           user.Username,
+		FamilyID:        family,
+		TokenHash:       util.HashToken(refresh),
+		AccessJTI:       jti,
+		AccessExpiresAt: expiresAt,
+		ExpiresAt:       now.Add(h.Config.JWT.RefreshTokenTTL),
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{AccessToken: access, RefreshToken: refresh, ExpiresAt: expiresAt}, nil
+}
+
+// denyAccessTokens adds jtis to the revocation list until they expire, and
+// drops the entries that expired in the meantime.
+func (d *Deps) denyAccessTokens(tx *gorm.DB, revoked []models.RevokedToken) error {
+	if err := tx.Where("expires_at <= ?", d.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error
+}
+
+// revokeRefreshTokens revokes the refresh tokens matching query and denies
+// the access tokens issued with them that are still valid.
+func (d *Deps) revokeRefreshTokens(tx *gorm.DB, query interface{}, args ...interface{}) error {
+	now := d.Now()
+
+	var tokens []models.RefreshToken
+	if err := tx.Where(query, args...).Where("access_expires_at > ?", now).Find(&tokens).Error; err != nil {
+		return err
+	}
+	revoked := make([]models.RevokedToken, 0, len(tokens))
+	for _, t := range tokens {
+		revoked = append(revoked, models.RevokedToken{JTI: t.AccessJTI, ExpiresAt: t.AccessExpiresAt})
+	}
+	if err := d.denyAccessTokens(tx, revoked); err != nil {
+		return err
+	}
+
+	return tx.Model(&models.RefreshToken{}).Where(query, args...).Where("revoked_at IS NULL").Update("revoked_at", now).Error
+}
+
+// @Summary	Refresh tokens
+// @Tags		Auth
+// @Description Trade a refresh token for a new access token and a new refresh token. Each refresh token works once; using one again revokes every token descended from the same login.
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.RefreshValidation	true	"Refresh token"
+// @Success	200		{object}	handler.Refresh.RefreshResponse	"Tokens refreshed"
+// @Failure	400		{object}	string					"Invalid fields"
+// @Failure	401		{object}	string					"Invalid, expired or revoked refresh token"
+// @Failure	500		{object}	string					"Internal server error"
+// @Router		/api/auth/refresh [post]
+func (h *Auth) Refresh(c *fiber.Ctx) error {
+	type RefreshResponse struct {
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	validate := validator.New()
+	db := h.DB
+
+	body := &models.RefreshValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var pair *tokenPair
+	reused := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current models.RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where(&models.RefreshToken{TokenHash: util.HashToken(body.RefreshToken)}).
+			First(&current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInvalidRefreshToken
+			}
+			return err
+		}
+		if current.RevokedAt != nil {
+			return errInvalidRefreshToken
+		}
+		// a rotated token is only presented again by someone who stole it,
+		// so nothing issued from that login can be trusted any more
+		if current.RotatedAt != nil {
+			reused = true
+			return h.revokeRefreshTokens(tx, "family_id = ?", current.FamilyID)
+		}
+		if h.Now().After(current.ExpiresAt) {
+			return errInvalidRefreshToken
+		}
+
+		user, err := h.getUserByUsername(current.Owner)
+		if err != nil {
+			return err
+		}
+		if user == nil || user.SuspendedAt != nil {
+			return errInvalidRefreshToken
+		}
+
+		if err := tx.Model(&current).Update("rotated_at", h.Now()).Error; err != nil {
+			return err
+		}
+		pair, err = h.issueTokens(tx, user, current.FamilyID)
+		return err
+	})
+	switch {
+	case errors.Is(err, errInvalidRefreshToken):
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired refresh token"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to refresh token", "data": err})
+	case reused:
+		return c.Status(401).JSON(fiber.Map{"error": "Refresh token reused, please login again"})
+	}
+
+	return c.JSON(RefreshResponse{Token: pair.AccessToken, RefreshToken: pair.RefreshToken, ExpiresAt: pair.ExpiresAt})
+}
+
+// @Summary	Logout
+// @Tags		Auth
+// @Description Revoke the access token and the refresh tokens of the login it came from.
+// @Security Bearer
+// @Produce	json
+// @Success	200		{object}	string	"Logged out"
+// @Failure	401		{object}	string	"Unauthorized"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/logout [post]
+func (h *Auth) Logout(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+	current := models.RevokedToken{JTI: user.TokenID, ExpiresAt: user.ExpiresAt}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var session models.RefreshToken
+		if err := tx.Where(&models.RefreshToken{AccessJTI: current.JTI}).Limit(1).Find(&session).Error; err != nil {
+			return err
+		}
+		if session.ID != 0 {
+			if err := h.revokeRefreshTokens(tx, "family_id = ?", session.FamilyID); err != nil {
+				return err
+			}
+		}
+		return h.denyAccessTokens(tx, []models.RevokedToken{current})
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to logout", "data": err})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Logged out successfully"})
+}
+
+// @Summary	Logout all devices
+// @Tags		Auth
+// @Description Revoke every refresh token of the user and every access token issued with them.
+// @Security Bearer
+// @Produce	json
+// @Success	200		{object}	string	"Logged out"
+// @Failure	401		{object}	string	"Unauthorized"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/logout/all [post]
+func (h *Auth) LogoutAll(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+	current := models.RevokedToken{JTI: user.TokenID, ExpiresAt: user.ExpiresAt}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := h.revokeRefreshTokens(tx, "owner = ?", username); err != nil {
+			return err
+		}
+		return h.denyAccessTokens(tx, []models.RevokedToken{current})
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to logout", "data": err})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Logged out of all devices successfully"})
+}
+
+// @Summary	JSON Web Key Set
+// @Tags		Auth
+// @Description The public keys access tokens are signed with, the active key and the previous keys still accepted, looked up by the token's kid.
+// @Produce	json
+// @Success	200		{object}	string	"JWKS"
+// @Router		/.well-known/jwks.json [get]
+func (h *Auth) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(h.Keys.JWKS())
+}
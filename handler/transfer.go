@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+)
+
+var errDailyLimit = errors.New("daily transfer limit exceeded")
+
+// @Summary Transfer balance
+// @Tags Transaction
+// @Description Send balance to another user. Subject to TRANSFER_MAX_AMOUNT per transfer and TRANSFER_DAILY_LIMIT per day when configured. Users with two-factor authentication send a code in X-2FA-Code from STEP_UP_THRESHOLD.
+// @Security Bearer
+// @Accept json
+// @Produce json
+// @Param body body models.TransferValidation true "Transfer"
+// @Param Idempotency-Key header string false "Replays the stored result of a retried request"
+// @Param X-2FA-Code header string false "Two-factor code, for amounts from STEP_UP_THRESHOLD"
+// @Success 201 {object} handler.Transfer.TransferResponse
+// @Failure 400 {object} string "Invalid fields, insufficient balance or limit exceeded"
+// @Failure 401 {object} string "Unauthorized, or two-factor code missing or invalid"
+// @Failure 404 {object} string "Recipient not found"
+// @Failure 422 {object} string "Idempotency-Key reused with a different request"
+// @Failure 429 {object} string "Too many invalid two-factor codes"
+// @Failure 500 {object} string "Failed to transfer"
+// @Router /api/transaction/transfer [post]
+func (h *Accounts) Transfer(c *fiber.Ctx) error {
+	type TransferResponse struct {
+		Invoice   string          `json:"invoice"`
+		Reference string          `json:"reference"`
+		Recipient string          `json:"recipient"`
+		Amount    models.Money    `json:"amount"`
+		Currency  models.Currency `json:"currency"`
+		Type      models.Type     `json:"type"`
+		Note      *string         `json:"note"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	username := user.Username
+	db := h.DB
+
+	body := &models.TransferValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid Fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	if body.Recipient == username {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot transfer to yourself"})
+	}
+	if limit := h.Config.Limits.TransferMaxAmount; limit != nil && body.Amount > *limit {
+		return c.Status(400).JSON(fiber.Map{"error": "Amount exceeds per-transaction transfer limit"})
+	}
+	if err := h.requireStepUp(c, username, body.Amount); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	recipient, err := h.GetAccountByUsername(body.Recipient)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to transfer", "data": err})
+	}
+	if recipient == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Recipient not found"})
+	}
+
+	reference := "TRF-" + uuid.NewString()
+	description := fmt.Sprintf("Transfer from %s to %s", username, recipient.Owner)
+	if body.Note != nil {
+		description = fmt.Sprintf("%s: %s", description, *body.Note)
+	}
+
+	now := h.Now().In(h.Location)
+	var out models.Order
+	err = db.Transaction(func(tx *gorm.DB) error {
+		accounts, err := lockAccounts(tx, username, recipient.Owner)
+		if err != nil {
+			return err
+		}
+		sender, receiver := accounts[username], accounts[recipient.Owner]
+		if sender == nil || receiver == nil {
+			return errAccountNotFound
+		}
+		if sender.Currency != receiver.Currency {
+			return errCurrencyMismatch
+		}
+		if body.Amount > sender.Balance {
+			return errInsufficientBalance
+		}
+
+		// the sender row is locked, so concurrent transfers see each other here
+		if limit := h.Config.Limits.TransferDailyLimit; limit != nil {
+			// the day in the business timezone, read off the same clock
+			// the orders are stamped with
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+			var sent models.Money
+			if err := tx.Model(&models.Order{}).
+				Select("COALESCE(SUM(amount), 0)").
+				Where("account_id = ? AND type = ? AND created_at >= ?", sender.ID, models.TransferOut, today).
+				Scan(&sent).Error; err != nil {
+				return err
+			}
+			total, err := sent.Add(body.Amount)
+			if err != nil || total > *limit {
+				return errDailyLimit
+			}
+		}
+
+		senderUtil, err := h.GetInvNumber(username)
+		if err != nil {
+			return err
+		}
+		receiverUtil, err := h.GetInvNumber(recipient.Owner)
+		if err != nil {
+			return err
+		}
+		out = models.Order{
+			AccountID:   sender.ID,
+			Invoice:     senderUtil.Invoice,
+			Amount:      body.Amount,
+			Currency:    sender.Currency,
+			Type:        models.TransferOut,
+			Status:      models.Completed,
+			Reference:   &reference,
+			Description: &description,
+		}
+		in := models.Order{
+			AccountID:   receiver.ID,
+			Invoice:     receiverUtil.Invoice,
+			Amount:      body.Amount,
+			Currency:    receiver.Currency,
+			Type:        models.TransferIn,
+			Status:      models.Completed,
+			Reference:   &reference,
+			Description: &description,
+		}
+		// stamped off the clock the daily limit is counted by
+		out.CreatedAt, in.CreatedAt = now, now
+		if err := tx.Create(&out).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&in).Error; err != nil {
+			return err
+		}
+
+		return ledger.Post(tx, &models.JournalEntry{
+			Reference:   reference,
+			Description: &description,
+			Postings: []models.Posting{
+				ledger.DebitAccount(sender, body.Amount, &out.ID),
+				ledger.CreditAccount(receiver, body.Amount, &in.ID),
+			},
+		})
+	})
+	switch {
+	case errors.Is(err, errInsufficientBalance):
+		return c.Status(400).JSON(fiber.Map{"error": "Insufficient balance"})
+	case errors.Is(err, errDailyLimit):
+		return c.Status(400).JSON(fiber.Map{"error": "Daily transfer limit exceeded"})
+	case errors.Is(err, errCurrencyMismatch):
+		return c.Status(400).JSON(fiber.Map{"error": "Recipient account currency does not match"})
+	case errors.Is(err, errAccountNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Account not found"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to transfer", "data": err})
+	}
+
+	response := TransferResponse{
+		Invoice:   out.Invoice,
+		Reference: reference,
+		Recipient: recipient.Owner,
+		Amount:    out.Amount,
+		Currency:  out.Currency,
+		Type:      out.Type,
+		Note:      body.Note,
+		CreatedAt: out.CreatedAt,
+	}
+
+	return c.Status(201).JSON(fiber.Map{"data": response})
+}
@@ -0,0 +1,473 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/totp"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	recoveryCodeCount       = 10
+	maxSecondFactorAttempts = 5
+	secondFactorLockout     = 15 * time.Minute
+)
+
+var (
+	errTwoFactorDisabled    = errors.New("two-factor authentication is not enabled")
+	errTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnrolled = errors.New("two-factor authentication is not enrolled")
+	errSecondFactorInvalid  = errors.New("invalid two-factor code")
+	errSecondFactorLocked   = errors.New("too many invalid two-factor codes")
+	errInvalidChallenge     = errors.New("invalid two-factor challenge")
+	errStepUpRequired       = errors.New("two-factor code required")
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func twoFactorError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errTwoFactorDisabled), errors.Is(err, errTwoFactorNotEnrolled):
+		return c.Status(409).JSON(fiber.Map{"error": "Two-factor authentication is not enabled"})
+	case errors.Is(err, errTwoFactorEnabled):
+		return c.Status(409).JSON(fiber.Map{"error": "Two-factor authentication is already enabled"})
+	case errors.Is(err, errSecondFactorInvalid):
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid two-factor code"})
+	case errors.Is(err, errSecondFactorLocked):
+		return c.Status(429).JSON(fiber.Map{"error": "Too many invalid two-factor codes, try again later"})
+	case errors.Is(err, errInvalidChallenge):
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired challenge, please login again"})
+	case errors.Is(err, errStepUpRequired):
+		return c.Status(401).JSON(fiber.Map{"error": "Two-factor code required for this amount, send it in the X-2FA-Code header"})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to verify two-factor code", "data": err})
+	}
+}
+
+// normalizeRecoveryCode drops the separators and case a user may type a
+// recovery code with.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes replaces the recovery codes of username and returns the
+// new ones, which are only ever shown this once.
+func newRecoveryCodes(tx *gorm.DB, username string) ([]string, error) {
+	if err := tx.Where("owner = ?", username).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	stored := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := recoveryEncoding.EncodeToString(raw)[:10]
+		codes = append(codes, strings.ToLower(code[:5]+"-"+code[5:]))
+		stored = append(stored, models.RecoveryCode{Owner: username, CodeHash: util.HashToken(code)})
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts an authenticator code or an unused recovery
+// code of username. It runs in its own transaction so that failures are
+// counted even when the caller's work fails; too many lock verification
+// for a while.
+func (d *Deps) checkSecondFactor(username, code string) error {
+	db := d.DB
+
+	invalid := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where(&models.User{Username: username}).First(&user).Error; err != nil {
+			return err
+		}
+		if user.TOTPEnabledAt == nil || user.TOTPSecret == nil {
+			return errTwoFactorDisabled
+		}
+		now := d.Now()
+		if user.TOTPLockedUntil != nil && now.Before(*user.TOTPLockedUntil) {
+			return errSecondFactorLocked
+		}
+
+		updates := map[string]interface{}{"totp_failed_attempts": 0, "totp_locked_until": nil}
+		if step, ok := totp.Validate(*user.TOTPSecret, code, now, 1); ok && step > user.TOTPLastStep {
+			updates["totp_last_step"] = step
+			return tx.Model(&user).Updates(updates).Error
+		}
+		res := tx.Model(&models.RecoveryCode{}).
+			Where("owner = ? AND code_hash = ? AND used_at IS NULL", username, util.HashToken(normalizeRecoveryCode(code))).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			return tx.Model(&user).Updates(updates).Error
+		}
+
+		invalid = true
+		updates["totp_failed_attempts"] = user.TOTPFailedAttempts + 1
+		if user.TOTPFailedAttempts+1 >= maxSecondFactorAttempts {
+			updates["totp_failed_attempts"], updates["totp_locked_until"] = 0, now.Add(secondFactorLockout)
+		}
+		return tx.Model(&user).Updates(updates).Error
+	})
+	if err != nil {
+		return err
+	}
+	if invalid {
+		return errSecondFactorInvalid
+	}
+	return nil
+}
+
+// requireStepUp asks username for a second factor, sent in the X-2FA-Code
+// header, when amount reaches the step-up threshold. Users without
+// two-factor authentication are not asked.
+func (d *Deps) requireStepUp(c *fiber.Ctx, username string, amount models.Money) error {
+	threshold := d.Config.Limits.StepUpThreshold
+	if threshold <= 0 || amount < threshold {
+		return nil
+	}
+	user, err := d.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.TOTPEnabledAt == nil {
+		return nil
+	}
+
+	code := c.Get("X-2FA-Code")
+	if code == "" {
+		return errStepUpRequired
+	}
+	return d.checkSecondFactor(username, code)
+}
+
+// createChallenge starts a two-factor login for username and returns its
+// token.
+func (h *Auth) createChallenge(tx *gorm.DB, username string) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := recoveryEncoding.EncodeToString(raw)
+	expiresAt := h.Now().Add(h.Config.Auth.TwoFactorChallengeTTL)
+	if err := tx.Create(&models.TwoFactorChallenge{
+		Owner:     username,
+		TokenHash: util.HashToken(token),
+		ExpiresAt: expiresAt,
+	}).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// @Summary	Enroll in two-factor authentication
+// @Tags		Auth
+// @Description Create a TOTP secret and its otpauth URI for an authenticator app. Two-factor authentication is on once enable confirms a code. Enrolling again replaces a secret that was not enabled yet.
+// @Security Bearer
+// @Produce	json
+// @Success	201		{object}	handler.EnrollTwoFactor.EnrollResponse
+// @Failure	401		{object}	string	"Unauthorized"
+// @Failure	409		{object}	string	"Already enabled"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/2fa/enroll [post]
+func (h *Auth) EnrollTwoFactor(c *fiber.Ctx) error {
+	type EnrollResponse struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri" example:"otpauth://totp/fiber-commerce:alice?algorithm=SHA1&digits=6&issuer=fiber-commerce&period=30&secret=JBSWY3DPEHPK3PXP"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to enroll", "data": err})
+	}
+	res := db.Model(&models.User{}).
+		Where("username = ? AND totp_enabled_at IS NULL", user.Username).
+		Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0})
+	if res.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to enroll", "data": res.Error})
+	}
+	if res.RowsAffected == 0 {
+		return twoFactorError(c, errTwoFactorEnabled)
+	}
+
+	return c.Status(201).JSON(EnrollResponse{Secret: secret, URI: totp.URI(h.Config.JWT.Issuer, user.Username, secret)})
+}
+
+// @Summary	Enable two-factor authentication
+// @Tags		Auth
+// @Description Confirm enrollment with a code from the authenticator app. Returns the recovery codes, which are only shown this once.
+// @Security Bearer
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.TwoFactorCodeValidation	true	"Authenticator code"
+// @Success	200		{object}	handler.EnableTwoFactor.RecoveryCodesResponse
+// @Failure	400		{object}	string	"Invalid fields"
+// @Failure	401		{object}	string	"Unauthorized or invalid code"
+// @Failure	409		{object}	string	"Not enrolled or already enabled"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/2fa/enable [post]
+func (h *Auth) EnableTwoFactor(c *fiber.Ctx) error {
+	type RecoveryCodesResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.TwoFactorCodeValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var account models.User
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where(&models.User{Username: user.Username}).First(&account).Error; err != nil {
+			return err
+		}
+		if account.TOTPEnabledAt != nil {
+			return errTwoFactorEnabled
+		}
+		if account.TOTPSecret == nil {
+			return errTwoFactorNotEnrolled
+		}
+		step, ok := totp.Validate(*account.TOTPSecret, body.Code, h.Now(), 1)
+		if !ok {
+			return errSecondFactorInvalid
+		}
+
+		if err := tx.Model(&account).Updates(map[string]interface{}{"totp_enabled_at": h.Now(), "totp_last_step": step}).Error; err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, user.Username)
+		return err
+	})
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.Status(200).JSON(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// @Summary	Disable two-factor authentication
+// @Tags		Auth
+// @Description Turn two-factor authentication off with an authenticator or recovery code. The secret and recovery codes are deleted.
+// @Security Bearer
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.TwoFactorCodeValidation	true	"Authenticator or recovery code"
+// @Success	200		{object}	string	"Disabled"
+// @Failure	400		{object}	string	"Invalid fields"
+// @Failure	401		{object}	string	"Unauthorized or invalid code"
+// @Failure	409		{object}	string	"Not enabled"
+// @Failure	429		{object}	string	"Too many invalid codes"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/2fa/disable [post]
+func (h *Auth) DisableTwoFactor(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.TwoFactorCodeValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	if err := h.checkSecondFactor(user.Username, body.Code); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("username = ?", user.Username).Updates(map[string]interface{}{
+			"totp_secret":     nil,
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("owner = ?", user.Username).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to disable two-factor authentication", "data": err})
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Two-factor authentication disabled"})
+}
+
+// @Summary	Regenerate recovery codes
+// @Tags		Auth
+// @Description Replace the recovery codes, confirmed with an authenticator or recovery code. The old codes stop working.
+// @Security Bearer
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.TwoFactorCodeValidation	true	"Authenticator or recovery code"
+// @Success	200		{object}	handler.RegenerateRecoveryCodes.RecoveryCodesResponse
+// @Failure	400		{object}	string	"Invalid fields"
+// @Failure	401		{object}	string	"Unauthorized or invalid code"
+// @Failure	409		{object}	string	"Not enabled"
+// @Failure	429		{object}	string	"Too many invalid codes"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/2fa/recovery-codes [post]
+func (h *Auth) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	type RecoveryCodesResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.TwoFactorCodeValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	if err := h.checkSecondFactor(user.Username, body.Code); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		codes, err = newRecoveryCodes(tx, user.Username)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to regenerate recovery codes", "data": err})
+	}
+
+	return c.Status(200).JSON(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// @Summary	Verify two-factor login
+// @Tags		Auth
+// @Description Finish a login that returned a challenge token, with an authenticator or recovery code.
+// @Accept		json
+// @Produce	json
+// @Param		body	body		models.VerifyTwoFactorValidation	true	"Challenge and code"
+// @Success	200		{object}	handler.VerifyTwoFactor.VerifyResponse	"User Logged In"
+// @Failure	400		{object}	string	"Invalid fields"
+// @Failure	401		{object}	string	"Invalid challenge or code"
+// @Failure	429		{object}	string	"Too many invalid codes"
+// @Failure	500		{object}	string	"Internal server error"
+// @Router		/api/auth/2fa/verify [post]
+func (h *Auth) VerifyTwoFactor(c *fiber.Ctx) error {
+	type VerifyResponse struct {
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	db := h.DB
+
+	body := &models.VerifyTwoFactorValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var challenge models.TwoFactorChallenge
+	if err := db.Where(&models.TwoFactorChallenge{TokenHash: util.HashToken(body.ChallengeToken)}).First(&challenge).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return twoFactorError(c, errInvalidChallenge)
+		}
+		return twoFactorError(c, err)
+	}
+	if challenge.UsedAt != nil || h.Now().After(challenge.ExpiresAt) {
+		return twoFactorError(c, errInvalidChallenge)
+	}
+
+	if err := h.checkSecondFactor(challenge.Owner, body.Code); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	var pair *tokenPair
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// a challenge logs in once
+		res := tx.Model(&challenge).Where("used_at IS NULL").Update("used_at", h.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errInvalidChallenge
+		}
+
+		user, err := h.getUserByUsername(challenge.Owner)
+		if err != nil {
+			return err
+		}
+		if user == nil || user.SuspendedAt != nil {
+			return errInvalidChallenge
+		}
+		pair, err = h.issueTokens(tx, user, "")
+		return err
+	})
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+
+	return c.JSON(VerifyResponse{Token: pair.AccessToken, RefreshToken: pair.RefreshToken, ExpiresAt: pair.ExpiresAt})
+}
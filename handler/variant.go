@@ -0,0 +1,346 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+)
+
+var (
+	errVariantNotFound  = errors.New("variant not found")
+	errVariantRequired  = errors.New("product is sold by variant")
+	errDuplicateOptions = errors.New("another variant has the same options")
+)
+
+type VariantData struct {
+	SKU      string         `json:"sku"`
+	Name     string         `json:"name"`
+	Price    models.Money   `json:"price"`
+	Options  models.Options `json:"options"`
+	Stock    *int           `json:"stock"`
+	LowStock bool           `json:"low_stock"`
+}
+
+func variantData(v models.ProductVariant, lowStockThreshold int) VariantData {
+	return VariantData{
+		SKU:      v.SKU,
+		Name:     v.Name,
+		Price:    v.Price,
+		Options:  v.Options,
+		Stock:    v.Stock,
+		LowStock: v.Stock != nil && *v.Stock <= lowStockThreshold,
+	}
+}
+
+// variantOptions collects the values each option takes across variants, the
+// axes of the product's variant matrix.
+func variantOptions(variants []models.ProductVariant) map[string][]string {
+	options := make(map[string][]string)
+	for _, v := range variants {
+		for name, value := range v.Options {
+			if !slices.Contains(options[name], value) {
+				options[name] = append(options[name], value)
+			}
+		}
+	}
+	for name := range options {
+		sort.Strings(options[name])
+	}
+	return options
+}
+
+func orderVariants(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+// resolveLine finds what a payment or cart line buys. With sku set it is
+// that variant, otherwise the product with code, which then must not have
+// variants. A line costing more than Money holds is rejected.
+func (d *Deps) resolveLine(code, sku string, qty int) (*orderLine, error) {
+	db := d.DB
+
+	if sku == "" {
+		product, err := d.GetProductByCode(code)
+		if err != nil {
+			return nil, err
+		}
+		if product == nil {
+			return nil, errProductNotFound
+		}
+		if product.Biller != nil {
+			return nil, errBillProduct
+		}
+		if len(product.Variants) > 0 {
+			return nil, errVariantRequired
+		}
+		return checkLine(&orderLine{Product: product, Qty: qty})
+	}
+
+	var variant models.ProductVariant
+	if err := db.Where(&models.ProductVariant{SKU: strings.ToUpper(sku)}).First(&variant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errVariantNotFound
+		}
+		return nil, err
+	}
+	var product models.Product
+	if err := db.Preload("Categories", orderCategories).Preload("Variants", orderVariants).First(&product, variant.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errVariantNotFound
+		}
+		return nil, err
+	}
+	if code != "" && strings.ToUpper(code) != product.Code {
+		return nil, errVariantNotFound
+	}
+
+	data := productData(product)
+	vd := variantData(variant, product.LowStockThreshold)
+	return checkLine(&orderLine{Product: &data, Variant: &vd, Qty: qty})
+}
+
+func checkLine(line *orderLine) (*orderLine, error) {
+	if _, err := line.subtotal(); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// canWriteProduct reports whether user may change a product of merchant:
+// its own, or any product with product:write:any.
+func canWriteProduct(user *util.CurUser, merchant string) bool {
+	return merchant == user.Username || user.Role.Can(models.ProductWriteAny)
+}
+
+// merchantProduct loads the product with code for a change by user, who
+// must be allowed to change it.
+func merchantProduct(tx *gorm.DB, code string, user *util.CurUser) (*models.Product, error) {
+	var product models.Product
+	if err := tx.Where(&models.Product{Code: strings.ToUpper(code)}).First(&product).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errProductNotFound
+		}
+		return nil, err
+	}
+	if !canWriteProduct(user, product.Merchant) {
+		return nil, errNotOrderParty
+	}
+	return &product, nil
+}
+
+// checkOptions rejects options already used by another variant of the
+// product, since the buyer could not tell the two apart.
+func checkOptions(tx *gorm.DB, productID uint, sku string, options models.Options) error {
+	var variants []models.ProductVariant
+	if err := tx.Where("product_id = ? AND sku <> ?", productID, sku).Find(&variants).Error; err != nil {
+		return err
+	}
+	for _, v := range variants {
+		if v.Options.Equal(options) {
+			return fmt.Errorf("%w: %s", errDuplicateOptions, v.SKU)
+		}
+	}
+	return nil
+}
+
+func variantError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Invalid product code"})
+	case errors.Is(err, errVariantNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Variant not found"})
+	case errors.Is(err, errNotOrderParty):
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	case errors.Is(err, errDuplicateOptions):
+		return c.Status(409).JSON(fiber.Map{"error": "Another variant has the same options", "data": err.Error()})
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return c.Status(409).JSON(fiber.Map{"error": "Variant's SKU already exists"})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save variant", "data": err})
+	}
+}
+
+// @Summary Create product variant
+// @Description Add a variant with its own SKU, price, stock and option values to a product. The product's merchant, or staff with product:write:any.
+// @Tags Products
+// @Security Bearer
+// @Security ApiKey
+// @Accept json
+// @Produce json
+// @Param code path string true "Product code"
+// @Param body body models.CreateVariantValidation true "Variant"
+// @Success 201 {object} handler.VariantData "Variant created"
+// @Failure 400 {object} string "Invalid fields"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Invalid product code"
+// @Failure 409 {object} string "SKU or options already exist"
+// @Failure 500 {object} string "Failed to save variant"
+// @Router /api/product/{code}/variants [post]
+func (h *Catalog) CreateVariant(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.CreateVariantValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var variant models.ProductVariant
+	var product *models.Product
+	err = db.Transaction(func(tx *gorm.DB) error {
+		found, err := merchantProduct(tx, c.Params("code"), user)
+		if err != nil {
+			return err
+		}
+		product = found
+
+		sku := strings.ToUpper(body.SKU)
+		if err := checkOptions(tx, product.ID, sku, body.Options); err != nil {
+			return err
+		}
+
+		variant = models.ProductVariant{
+			ProductID: product.ID,
+			SKU:       sku,
+			Name:      body.Name,
+			Price:     body.Price,
+			Options:   body.Options,
+			Stock:     body.Stock,
+		}
+		return tx.Create(&variant).Error
+	})
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	return c.Status(201).JSON(variantData(variant, product.LowStockThreshold))
+}
+
+// @Summary Update product variant
+// @Description Change a variant's name, price or option values. Stock is changed through the stock endpoint. The product's merchant, or staff with product:write:any.
+// @Tags Products
+// @Security Bearer
+// @Security ApiKey
+// @Accept json
+// @Produce json
+// @Param code path string true "Product code"
+// @Param sku path string true "Variant SKU"
+// @Param body body models.UpdateVariantValidation true "Variant"
+// @Success 200 {object} handler.VariantData "Variant updated"
+// @Failure 400 {object} string "Invalid fields"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product or variant not found"
+// @Failure 409 {object} string "Options already exist"
+// @Failure 500 {object} string "Failed to save variant"
+// @Router /api/product/{code}/variants/{sku} [put]
+func (h *Catalog) UpdateVariant(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	body := &models.UpdateVariantValidation{}
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid fields"})
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(body); err != nil {
+		errMsgs := make([]string, 0)
+		for _, e := range err.(validator.ValidationErrors) {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %s %s", e.Field(), e.Tag(), e.Param()))
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errMsgs})
+	}
+
+	var variant models.ProductVariant
+	var product *models.Product
+	err = db.Transaction(func(tx *gorm.DB) error {
+		found, err := merchantProduct(tx, c.Params("code"), user)
+		if err != nil {
+			return err
+		}
+		product = found
+
+		if err := tx.Where("product_id = ? AND sku = ?", product.ID, strings.ToUpper(c.Params("sku"))).First(&variant).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errVariantNotFound
+			}
+			return err
+		}
+		if err := checkOptions(tx, product.ID, variant.SKU, body.Options); err != nil {
+			return err
+		}
+
+		variant.Name, variant.Price, variant.Options = body.Name, body.Price, body.Options
+		return tx.Select("name", "price", "options").Save(&variant).Error
+	})
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	return c.Status(200).JSON(variantData(variant, product.LowStockThreshold))
+}
+
+// @Summary Delete product variant
+// @Description Delete a variant. Past orders keep their SKU. The product's merchant, or staff with product:write:any.
+// @Tags Products
+// @Security Bearer
+// @Security ApiKey
+// @Produce json
+// @Param code path string true "Product code"
+// @Param sku path string true "Variant SKU"
+// @Success 200 {object} string "Variant deleted"
+// @Failure 401 {object} string "Unauthorized"
+// @Failure 404 {object} string "Product or variant not found"
+// @Failure 500 {object} string "Failed to save variant"
+// @Router /api/product/{code}/variants/{sku} [delete]
+func (h *Catalog) DeleteVariant(c *fiber.Ctx) error {
+	user, err := util.CurrentUser(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	db := h.DB
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		product, err := merchantProduct(tx, c.Params("code"), user)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Where("product_id = ? AND sku = ?", product.ID, strings.ToUpper(c.Params("sku"))).Delete(&models.ProductVariant{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVariantNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	return c.Status(200).JSON(fiber.Map{"message": "Variant deleted successfully"})
+}
@@ -0,0 +1,62 @@
+package invoice
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+)
+
+func TestNextAcrossDays(t *testing.T) {
+	db := dbtest.Open(t)
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:59 and then 00:01 the next day in Jakarta
+	days := []time.Time{
+		time.Date(2024, 3, 1, 23, 59, 0, 0, jakarta),
+		time.Date(2024, 3, 2, 0, 1, 0, 0, jakarta),
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		want   []string
+	}{
+		{"per day", "{prefix}{date}-{ns}-{seq}", []string{"INV01032024-%s-0001", "INV01032024-%s-0002", "INV02032024-%s-0001", "INV02032024-%s-0002"}},
+		{"without date", "{prefix}-{ns}-{seq}", []string{"INV-%s-0001", "INV-%s-0002", "INV-%s-0003", "INV-%s-0004"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := dbtest.Name("inv")
+			day := 0
+			g := &Generator{
+				Format:     tt.format,
+				Prefix:     "INV",
+				DateLayout: "02012006",
+				Padding:    4,
+				Location:   jakarta,
+				// UTC clock, so the date must come from Location
+				Now: func() time.Time { return days[day].UTC() },
+			}
+
+			seen := make(map[string]bool)
+			for i, want := range tt.want {
+				day = i / 2
+				got, err := g.Next(db, ns)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want = fmt.Sprintf(want, ns); got != want {
+					t.Errorf("number %d = %q, want %q", i, got, want)
+				}
+				if seen[got] {
+					t.Errorf("number %q handed out twice", got)
+				}
+				seen[got] = true
+			}
+		})
+	}
+}
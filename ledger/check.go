@@ -0,0 +1,93 @@
+package ledger
+
+import (
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"gorm.io/gorm"
+)
+
+// Discrepancy is an account whose cached balance differs from the sum of
+// its postings.
+type Discrepancy struct {
+	AccountID uint         `json:"account_id"`
+	Owner     string       `json:"owner"`
+	Cached    models.Money `json:"cached"`
+	Posted    models.Money `json:"posted"`
+}
+
+const postedBalanceSQL = "COALESCE(SUM(CASE WHEN postings.direction = 'CREDIT' THEN postings.amount ELSE -postings.amount END), 0)"
+
+// Check reports every account whose cached balance disagrees with its
+// postings. An empty result means the projection is consistent.
+func Check(db *gorm.DB) ([]Discrepancy, error) {
+	var discrepancies []Discrepancy
+	err := db.Table("accounts").
+		Select("accounts.id AS account_id, accounts.owner, accounts.balance AS cached, " + postedBalanceSQL + " AS posted").
+		Joins("LEFT JOIN postings ON postings.account_id = accounts.id AND postings.deleted_at IS NULL").
+		Where("accounts.deleted_at IS NULL").
+		Group("accounts.id").
+		Having("accounts.balance <> " + postedBalanceSQL).
+		Order("accounts.id").
+		Scan(&discrepancies).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return discrepancies, nil
+}
+
+// Balance computes an account balance from its postings alone.
+func Balance(db *gorm.DB, accountID uint) (models.Money, error) {
+	var balance models.Money
+	err := db.Model(&models.Posting{}).
+		Select(postedBalanceSQL).
+		Where("account_id = ?", accountID).
+		Scan(&balance).Error
+
+	return balance, err
+}
+
+// OpenBalances records an opening entry for every account whose cached
+// balance predates the ledger, so that Check starts out clean. It only runs
+// while the journal is still empty and leaves cached balances untouched.
+func OpenBalances(db *gorm.DB) error {
+	var entries int64
+	if err := db.Model(&models.JournalEntry{}).Count(&entries).Error; err != nil {
+		return err
+	}
+	if entries > 0 {
+		return nil
+	}
+
+	var accounts []models.Account
+	if err := db.Where("balance <> 0").Find(&accounts).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range accounts {
+			account := &accounts[i]
+			amount := account.Balance
+			var postings []models.Posting
+			if amount > 0 {
+				postings = []models.Posting{
+					CreditAccount(account, amount, nil),
+					DebitSystem(OpeningBalance, amount, account.Currency),
+				}
+			} else {
+				postings = []models.Posting{
+					DebitAccount(account, -amount, nil),
+					CreditSystem(OpeningBalance, -amount, account.Currency),
+				}
+			}
+
+			entry := models.JournalEntry{Reference: "OPENING-" + account.Owner, Postings: postings}
+			if err := validate(&entry); err != nil {
+				return err
+			}
+			if err := tx.Create(&entry).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+// Package ledger keeps account balances as double-entry bookkeeping. Every
+// balance change is a balanced journal entry; models.Account.Balance is a
+// cached projection of the account's postings, updated in the same
+// transaction and verified by Check.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"gorm.io/gorm"
+)
+
+// System accounts are the platform-side counterparts of user postings.
+const (
+	// External is money entering or leaving the platform, e.g. top-ups.
+	External = "EXTERNAL"
+	// OpeningBalance funds balances that existed before the ledger did.
+	OpeningBalance = "OPENING_BALANCE"
+	// Adjustment is the counterpart of staff balance corrections.
+	Adjustment = "ADJUSTMENT"
+)
+
+var (
+	ErrUnbalanced      = errors.New("journal entry is not balanced")
+	ErrInvalidPosting  = errors.New("invalid posting")
+	ErrCurrencyMixed   = errors.New("journal entry mixes currencies")
+	ErrTooFewPostings  = errors.New("journal entry needs at least two postings")
+	ErrAccountNotFound = errors.New("posting account not found")
+)
+
+// DebitAccount takes amount out of a user account.
+func DebitAccount(account *models.Account, amount models.Money, orderID *uint) models.Posting {
+	return models.Posting{AccountID: &account.ID, OrderID: orderID, Direction: models.Debit, Amount: amount, Currency: account.Currency}
+}
+
+// CreditAccount puts amount into a user account.
+func CreditAccount(account *models.Account, amount models.Money, orderID *uint) models.Posting {
+	return models.Posting{AccountID: &account.ID, OrderID: orderID, Direction: models.Credit, Amount: amount, Currency: account.Currency}
+}
+
+// DebitSystem takes amount out of a named system account.
+func DebitSystem(name string, amount models.Money, currency models.Currency) models.Posting {
+	return models.Posting{SystemAccount: &name, Direction: models.Debit, Amount: amount, Currency: currency}
+}
+
+// CreditSystem puts amount into a named system account.
+func CreditSystem(name string, amount models.Money, currency models.Currency) models.Posting {
+	return models.Posting{SystemAccount: &name, Direction: models.Credit, Amount: amount, Currency: currency}
+}
+
+// Post validates and records entry, then applies its account postings to
+// the cached balances. tx should be the caller's transaction so the entry
+// commits or rolls back together with the orders it belongs to.
+func Post(tx *gorm.DB, entry *models.JournalEntry) error {
+	if err := validate(entry); err != nil {
+		return err
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return err
+	}
+
+	deltas := make(map[uint]models.Money)
+	for _, p := range entry.Postings {
+		if p.AccountID == nil {
+			continue
+		}
+		deltas[*p.AccountID] += signed(p)
+	}
+	for id, delta := range deltas {
+		res := tx.Model(&models.Account{}).Where("id = ?", id).Update("balance", gorm.Expr("balance + ?", delta))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w: %d", ErrAccountNotFound, id)
+		}
+	}
+
+	return nil
+}
+
+func validate(entry *models.JournalEntry) error {
+	if len(entry.Postings) < 2 {
+		return ErrTooFewPostings
+	}
+
+	var debits, credits models.Money
+	currency := entry.Postings[0].Currency
+	for _, p := range entry.Postings {
+		if p.Amount <= 0 || (p.AccountID == nil) == (p.SystemAccount == nil) {
+			return ErrInvalidPosting
+		}
+		if p.Currency != currency {
+			return ErrCurrencyMixed
+		}
+		switch p.Direction {
+		case models.Debit:
+			debits += p.Amount
+		case models.Credit:
+			credits += p.Amount
+		default:
+			return ErrInvalidPosting
+		}
+	}
+	if debits != credits {
+		return fmt.Errorf("%w: debits %s, credits %s", ErrUnbalanced, debits, credits)
+	}
+
+	return nil
+}
+
+// signed is the effect of p on its account balance.
+func signed(p models.Posting) models.Money {
+	if p.Direction == models.Debit {
+		return -p.Amount
+	}
+	return p.Amount
+}
@@ -0,0 +1,123 @@
+package ledger_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/ledger"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"gorm.io/gorm"
+)
+
+func TestPostRejects(t *testing.T) {
+	account := &models.Account{Currency: models.IDR}
+	account.ID = 1
+	usd := models.Currency("USD")
+	amount := models.NewMoney(1000)
+
+	tests := []struct {
+		name     string
+		postings []models.Posting
+		want     error
+	}{
+		{"no postings", nil, ledger.ErrTooFewPostings},
+		{"one posting", []models.Posting{ledger.CreditAccount(account, amount, nil)}, ledger.ErrTooFewPostings},
+		{"unbalanced", []models.Posting{
+			ledger.CreditAccount(account, amount, nil),
+			ledger.DebitSystem(ledger.External, amount-1, models.IDR),
+		}, ledger.ErrUnbalanced},
+		{"one sided", []models.Posting{
+			ledger.CreditAccount(account, amount, nil),
+			ledger.CreditSystem(ledger.External, amount, models.IDR),
+		}, ledger.ErrUnbalanced},
+		{"mixed currencies", []models.Posting{
+			ledger.CreditAccount(account, amount, nil),
+			ledger.DebitSystem(ledger.External, amount, usd),
+		}, ledger.ErrCurrencyMixed},
+		{"zero amount", []models.Posting{
+			ledger.CreditAccount(account, 0, nil),
+			ledger.DebitSystem(ledger.External, 0, models.IDR),
+		}, ledger.ErrInvalidPosting},
+		{"negative amount", []models.Posting{
+			ledger.CreditAccount(account, -amount, nil),
+			ledger.DebitSystem(ledger.External, -amount, models.IDR),
+		}, ledger.ErrInvalidPosting},
+		{"no account", []models.Posting{
+			{Direction: models.Credit, Amount: amount, Currency: models.IDR},
+			ledger.DebitSystem(ledger.External, amount, models.IDR),
+		}, ledger.ErrInvalidPosting},
+		{"unknown direction", []models.Posting{
+			ledger.CreditAccount(account, amount, nil),
+			{SystemAccount: strPtr(ledger.External), Direction: models.Direction("SIDEWAYS"), Amount: amount, Currency: models.IDR},
+		}, ledger.ErrInvalidPosting},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// rejected before anything is written, so no database is needed
+			err := ledger.Post(nil, &models.JournalEntry{Reference: "TEST", Postings: tt.postings})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReportsTamperedBalance(t *testing.T) {
+	db := dbtest.Open(t)
+	username := dbtest.Name("ledger")
+	user := models.User{Username: username, Password: "-", Role: models.Role("CLIENT"), Account: &models.Account{Owner: username, Currency: models.IDR}}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	account := user.Account
+
+	amount := models.NewMoney(1000)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return ledger.Post(tx, &models.JournalEntry{
+			Reference: "TOPUP-" + username,
+			Postings: []models.Posting{
+				ledger.DebitSystem(ledger.External, amount, models.IDR),
+				ledger.CreditAccount(account, amount, nil),
+			},
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := discrepancy(t, db, account.ID); d != nil {
+		t.Fatalf("consistent account reported: %+v", d)
+	}
+
+	// a balance written around the ledger
+	if err := db.Model(&models.Account{}).Where("id = ?", account.ID).Update("balance", gorm.Expr("balance + 1")).Error; err != nil {
+		t.Fatal(err)
+	}
+	d := discrepancy(t, db, account.ID)
+	if d == nil {
+		t.Fatal("tampered balance not reported")
+	}
+	if d.Owner != username || d.Cached != amount+1 || d.Posted != amount {
+		t.Fatalf("got %+v, want %s cached and %s posted for %s", d, amount+1, amount, username)
+	}
+}
+
+// discrepancy is what Check reports for accountID, if anything; the test
+// database holds the accounts of other tests too.
+func discrepancy(t *testing.T, db *gorm.DB, accountID uint) *ledger.Discrepancy {
+	t.Helper()
+	discrepancies, err := ledger.Check(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range discrepancies {
+		if discrepancies[i].AccountID == accountID {
+			return &discrepancies[i]
+		}
+	}
+	return nil
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,130 @@
+// Package mailer sends the emails of the auth flows. Mailer is implemented
+// by SMTP, for a real server or a local stand-in such as MailHog, and by
+// Log, which writes messages to a file or the log instead of sending them.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilhamosaurus/fiber-commerce/config"
+)
+
+var ErrInvalidHeader = errors.New("header contains a line break")
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the mailer cfg picks: "smtp" sends through SMTPHost and
+// SMTPPort, and "log" writes to LogFile or the log.
+func New(cfg config.Mail) (Mailer, error) {
+	switch cfg.Mailer {
+	case "smtp":
+		return &SMTP{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		}, nil
+	case "log":
+		return &Log{Path: cfg.LogFile, From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mailer %q, want smtp or log", cfg.Mailer)
+	}
+}
+
+// SMTP sends through an SMTP server, authenticating with PLAIN when
+// Username is set. net/smtp only sends credentials over TLS or to
+// localhost.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTP) Send(msg Message) error {
+	data, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, data)
+}
+
+// Log appends messages to the file at Path, or writes them to the log when
+// Path is empty, for local development.
+type Log struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *Log) Send(msg Message) error {
+	data, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if m.Path == "" {
+		log.Printf("mail:\n%s", data)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
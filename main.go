@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/swagger"
+	"github.com/ilhamosaurus/fiber-commerce/biller"
+	"github.com/ilhamosaurus/fiber-commerce/config"
 	"github.com/ilhamosaurus/fiber-commerce/database"
 	_ "github.com/ilhamosaurus/fiber-commerce/docs"
+	"github.com/ilhamosaurus/fiber-commerce/handler"
+	"github.com/ilhamosaurus/fiber-commerce/invoice"
+	"github.com/ilhamosaurus/fiber-commerce/mailer"
 	"github.com/ilhamosaurus/fiber-commerce/routes"
+	"github.com/ilhamosaurus/fiber-commerce/signing"
 )
 
 // @title			Fiber-Mini Commerce
@@ -21,9 +31,42 @@ import (
 // @securityDefinitions.apikey Bearer
 // @in header
 // @name Authorization
+// @securityDefinitions.apikey ApiKey
+// @in header
+// @name X-API-Key
 // @BasePath		/
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+	keys, err := signing.Load(cfg.JWT)
+	if err != nil {
+		log.Fatal("failed to load signing keys: ", err)
+	}
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		log.Fatal("failed to set up mailer: ", err)
+	}
+	invoices, err := invoice.New(cfg.Invoice)
+	if err != nil {
+		log.Fatal("failed to set up invoices: ", err)
+	}
+	location, err := time.LoadLocation(cfg.Server.Timezone)
+	if err != nil {
+		log.Fatal("failed to load timezone: ", err)
+	}
+	billers := biller.NewRegistry()
+	if err := billers.RegisterMock(cfg.Billing.BillerMockFile); err != nil {
+		log.Printf("mock biller not loaded: %v", err)
+	}
+
 	app := fiber.New(fiber.Config{
+		// behind a reverse proxy, the header it puts the client address in,
+		// e.g. X-Forwarded-For; login throttling counts per address
+		ProxyHeader:  cfg.Server.ProxyHeader,
+		ReadTimeout:  cfg.Server.RequestTimeout,
+		WriteTimeout: cfg.Server.RequestTimeout,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			return c.Status(400).JSON(fiber.Map{
 				"error": err.Error(),
@@ -31,15 +74,27 @@ func main() {
 		},
 	})
 
-	app.Use(cors.New())
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     strings.Join(cfg.CORS.AllowOrigins, ","),
+		AllowCredentials: cfg.CORS.AllowCredentials,
+	}))
 	app.Use(logger.New())
-	database.ConnectDb()
+	services := handler.New(handler.Deps{
+		DB:       database.ConnectDb(cfg.Database),
+		Config:   cfg,
+		Keys:     keys,
+		Mailer:   mail,
+		Invoices: invoices,
+		Billers:  billers,
+		Location: location,
+	})
+	go services.Billing.RunSubscriptions(context.Background())
 
 	app.Get("/api-docs/*", swagger.HandlerDefault)
 
-	routes.SetupRoutes(app)
+	routes.SetupRoutes(app, services)
 
-	err := app.Listen(":6012")
+	err = app.Listen(fmt.Sprintf(":%d", cfg.Server.Port))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,130 @@
+package middleware_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/middleware"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/signing"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newKeySet(t *testing.T) *signing.KeySet {
+	t.Helper()
+	key, err := signing.Generate("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := signing.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// accessToken signs the claims of an access token for a user named
+// username, after modify has its way with them.
+func accessToken(t *testing.T, keys *signing.KeySet, cfg config.JWT, jti string, modify func(c *util.Claims)) string {
+	t.Helper()
+	user := &models.User{Username: "client", Role: models.Role("CLIENT")}
+	user.ID = 7
+	claims := util.NewClaims(cfg, user, jti, now.Add(-time.Minute), now.Add(cfg.AccessTokenTTL))
+	modify(claims)
+	token, err := keys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// protectedStatus is the status of a request to a route behind guard with
+// authorization as its Authorization header.
+func protectedStatus(t *testing.T, guard *middleware.Guard, authorization string) int {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/", guard.Protected(), func(c *fiber.Ctx) error {
+		return c.SendStatus(200)
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestProtectedRejects(t *testing.T) {
+	keys := newKeySet(t)
+	cfg := config.Default().JWT
+	// these are refused before the database is asked about revocation
+	guard := middleware.NewGuard(nil, keys, cfg, func() time.Time { return now })
+
+	refresh := make([]byte, 32)
+	if _, err := rand.Read(refresh); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{"missing", ""},
+		{"no bearer", accessToken(t, keys, cfg, "jti", func(c *util.Claims) {})},
+		{"garbage bearer", "Bearer not-a-jwt"},
+		{"unknown kid", "Bearer " + accessToken(t, newKeySet(t), cfg, "jti", func(c *util.Claims) {})},
+		{"refresh token", "Bearer " + base64.RawURLEncoding.EncodeToString(refresh)},
+		{"not an access token", "Bearer " + accessToken(t, keys, cfg, "jti", func(c *util.Claims) { c.Type = "refresh" })},
+		{"expired", "Bearer " + accessToken(t, keys, cfg, "jti", func(c *util.Claims) { c.ExpiresAt.Time = now.Add(-time.Second) })},
+		{"wrong audience", "Bearer " + accessToken(t, keys, cfg, "jti", func(c *util.Claims) { c.Audience = []string{"someone-else"} })},
+		{"wrong issuer", "Bearer " + accessToken(t, keys, cfg, "jti", func(c *util.Claims) { c.Issuer = "someone-else" })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := protectedStatus(t, guard, tt.authorization); code != 401 {
+				t.Fatalf("status %d, want 401", code)
+			}
+		})
+	}
+}
+
+func TestProtectedRevoked(t *testing.T) {
+	db := dbtest.Open(t)
+	keys := newKeySet(t)
+	cfg := config.Default().JWT
+	guard := middleware.NewGuard(db, keys, cfg, func() time.Time { return now })
+
+	valid, revoked := uuid.NewString(), uuid.NewString()
+	if err := db.Create(&models.RevokedToken{JTI: revoked, ExpiresAt: now.Add(cfg.AccessTokenTTL)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		jti  string
+		want int
+	}{
+		{"valid", valid, 200},
+		{"revoked", revoked, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := accessToken(t, keys, cfg, tt.jti, func(c *util.Claims) {})
+			if code := protectedStatus(t, guard, "Bearer "+token); code != tt.want {
+				t.Fatalf("status %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
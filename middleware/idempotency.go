@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Idempotency makes POST requests carrying an Idempotency-Key header safe to
+// retry. The first response for a key is stored per user and replayed for
+// later requests with the same key and body; reusing a key with a different
+// body is rejected with 422, and one still in progress with 409 until its
+// lease runs out, when a retry may assume it crashed and run in its place.
+// Keys are stored in db and expire after ttl, read off clock. It must run
+// after Protected.
+func Idempotency(db *gorm.DB, ttl, lease time.Duration, clock func() time.Time) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if key == "" || c.Method() != fiber.MethodPost {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(400).JSON(fiber.Map{"error": "Idempotency-Key is too long"})
+		}
+
+		user, err := util.CurrentUser(c)
+		if err != nil {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		owner := user.Username
+
+		sum := sha256.New()
+		sum.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+		sum.Write(c.Body())
+		hash := hex.EncodeToString(sum.Sum(nil))
+
+		now := clock()
+
+		// an expired key is free to be used again
+		if err := db.Where("owner = ? AND key = ? AND expires_at <= ?", owner, key, now).Delete(&models.IdempotencyKey{}).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check Idempotency-Key", "data": err})
+		}
+
+		lockedUntil := now.Add(lease)
+		record := models.IdempotencyKey{
+			Owner:       owner,
+			Key:         key,
+			RequestHash: hash,
+			LockedUntil: &lockedUntil,
+			ExpiresAt:   now.Add(ttl),
+		}
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if res.Error != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to check Idempotency-Key", "data": res.Error})
+		}
+
+		if res.RowsAffected == 0 {
+			var stored models.IdempotencyKey
+			if err := db.Where("owner = ? AND key = ?", owner, key).First(&stored).Error; err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to check Idempotency-Key", "data": err})
+			}
+			if stored.RequestHash != hash {
+				return c.Status(422).JSON(fiber.Map{"error": "Idempotency-Key was already used with a different request"})
+			}
+			if stored.StatusCode != 0 {
+				c.Set("Idempotent-Replayed", "true")
+				c.Set(fiber.HeaderContentType, stored.ContentType)
+				return c.Status(stored.StatusCode).Send(stored.ResponseBody)
+			}
+
+			// the first request's lease ran out without an outcome, so it is
+			// taken over; of concurrent retries only one wins the update
+			res := db.Model(&models.IdempotencyKey{}).
+				Where("id = ? AND status_code = 0 AND (locked_until IS NULL OR locked_until <= ?)", stored.ID, now).
+				Update("locked_until", lockedUntil)
+			if res.Error != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to check Idempotency-Key", "data": res.Error})
+			}
+			if res.RowsAffected == 0 {
+				return c.Status(409).JSON(fiber.Map{"error": "A request with this Idempotency-Key is still being processed"})
+			}
+			record = stored
+		}
+
+		if err := c.Next(); err != nil {
+			db.Delete(&record)
+			return err
+		}
+
+		// server errors are not final, let the client retry with the same key;
+		// neither is a missing or rate limited two-factor code, which the
+		// retry adds
+		status := c.Response().StatusCode()
+		if status >= 500 || status == 401 || status == 429 {
+			db.Delete(&record)
+			return nil
+		}
+
+		return db.Model(&record).Updates(map[string]interface{}{
+			"status_code":   status,
+			"content_type":  string(c.Response().Header.ContentType()),
+			"response_body": c.Response().Body(),
+		}).Error
+	}
+}
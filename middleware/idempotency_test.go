@@ -0,0 +1,174 @@
+package middleware_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/middleware"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+const (
+	idempotencyTTL   = time.Hour
+	idempotencyLease = time.Minute
+)
+
+// idempotentApp serves POST / behind Idempotency for a user of its own. The
+// handler counts its runs, and holds each until release is closed once
+// entered has been signalled, when hold is set.
+type idempotentApp struct {
+	app     *fiber.App
+	mu      sync.Mutex
+	now     time.Time
+	runs    atomic.Int32
+	hold    bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newIdempotentApp(t *testing.T) *idempotentApp {
+	t.Helper()
+	db := dbtest.Open(t)
+	a := &idempotentApp{now: now, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	username := dbtest.Name("user")
+
+	a.app = fiber.New()
+	a.app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &util.CurUser{Username: username})
+		return c.Next()
+	})
+	a.app.Post("/", middleware.Idempotency(db, idempotencyTTL, idempotencyLease, a.clock), func(c *fiber.Ctx) error {
+		run := a.runs.Add(1)
+		if a.hold && run == 1 {
+			a.entered <- struct{}{}
+			<-a.release
+		}
+		return c.Status(201).JSON(fiber.Map{"run": run, "body": string(c.Body())})
+	})
+	return a
+}
+
+func (a *idempotentApp) clock() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.now
+}
+
+func (a *idempotentApp) advance(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.now = a.now.Add(d)
+}
+
+// post sends body with key, returning the status, the response body and
+// whether it was replayed.
+func (a *idempotentApp) post(key, body string) (int, string, bool, error) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	res, err := a.app.Test(req, -1)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	return res.StatusCode, string(raw), res.Header.Get("Idempotent-Replayed") == "true", err
+}
+
+func mustPost(t *testing.T, a *idempotentApp, key, body string) (int, string, bool) {
+	t.Helper()
+	status, response, replayed, err := a.post(key, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, response, replayed
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	a := newIdempotentApp(t)
+
+	status, first, replayed := mustPost(t, a, "key", `{"amount":1}`)
+	if status != 201 || replayed {
+		t.Fatalf("first request: status %d, replayed %v", status, replayed)
+	}
+	status, second, replayed := mustPost(t, a, "key", `{"amount":1}`)
+	if status != 201 || !replayed || second != first {
+		t.Fatalf("retry: status %d, replayed %v, body %s, want 201 replaying %s", status, replayed, second, first)
+	}
+	if runs := a.runs.Load(); runs != 1 {
+		t.Fatalf("handler ran %d times, want 1", runs)
+	}
+}
+
+func TestIdempotencyDifferentBody(t *testing.T) {
+	a := newIdempotentApp(t)
+
+	if status, _, _ := mustPost(t, a, "key", `{"amount":1}`); status != 201 {
+		t.Fatalf("first request: status %d", status)
+	}
+	if status, _, _ := mustPost(t, a, "key", `{"amount":2}`); status != 422 {
+		t.Fatalf("different body: status %d, want 422", status)
+	}
+	if runs := a.runs.Load(); runs != 1 {
+		t.Fatalf("handler ran %d times, want 1", runs)
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	a := newIdempotentApp(t)
+	a.hold = true
+
+	done := make(chan int)
+	go func() {
+		status, _, _, err := a.post("key", `{"amount":1}`)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- status
+	}()
+	<-a.entered
+
+	// within the lease the retry waits for the first request's outcome
+	if status, _, _ := mustPost(t, a, "key", `{"amount":1}`); status != 409 {
+		t.Fatalf("retry in flight: status %d, want 409", status)
+	}
+
+	// past it the first request is taken to have crashed, and the retry
+	// runs in its place
+	a.advance(idempotencyLease)
+	if status, _, replayed := mustPost(t, a, "key", `{"amount":1}`); status != 201 || replayed {
+		t.Fatalf("retry after the lease: status %d, replayed %v, want 201", status, replayed)
+	}
+
+	close(a.release)
+	if status := <-done; status != 201 {
+		t.Fatalf("first request: status %d", status)
+	}
+	if runs := a.runs.Load(); runs != 2 {
+		t.Fatalf("handler ran %d times, want 2", runs)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	a := newIdempotentApp(t)
+
+	if status, _, _ := mustPost(t, a, "key", `{"amount":1}`); status != 201 {
+		t.Fatalf("first request: status %d", status)
+	}
+
+	// an expired key is free again, even for another body
+	a.advance(idempotencyTTL)
+	status, _, replayed := mustPost(t, a, "key", `{"amount":2}`)
+	if status != 201 || replayed {
+		t.Fatalf("after expiry: status %d, replayed %v, want 201", status, replayed)
+	}
+	if runs := a.runs.Load(); runs != 2 {
+		t.Fatalf("handler ran %d times, want 2", runs)
+	}
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+// Require lets a request through only when the user's role has every one
+// of perms. It must run after Protected.
+func Require(perms ...models.Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := util.CurrentUser(c)
+		if err != nil || !user.Role.Can(perms...) {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		return c.Next()
+	}
+}
@@ -4,7 +4,8 @@ import "gorm.io/gorm"
 
 type Account struct {
 	gorm.Model
-	Owner   string  `json:"owner" gorm:"unique;not null"`
-	Balance float64 `json:"balance" gorm:"type:numeric(10,2);not null"`
-	User    User    `gorm:"foreignKey:Owner;references:Username"`
+	Owner    string   `json:"owner" gorm:"unique;not null"`
+	Balance  Money    `json:"balance" gorm:"type:bigint;not null"`
+	Currency Currency `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
+	User     User     `gorm:"foreignKey:Owner;references:Username"`
 }
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scope limits what an API key may do, on top of what its owner's role may.
+type Scope string
+
+const (
+	ProductsWrite Scope = "products:write"
+	OrdersRead    Scope = "orders:read"
+	OrdersWrite   Scope = "orders:write"
+)
+
+// scopePermissions is what a role needs to grant a scope.
+var scopePermissions = map[Scope][]Permission{
+	ProductsWrite: {ProductWriteOwn},
+	OrdersRead:    {},
+	OrdersWrite:   {},
+}
+
+// CanGrant reports whether r may create API keys with scope.
+func (r Role) CanGrant(scope Scope) bool {
+	perms, ok := scopePermissions[scope]
+	return ok && r.Can(APIKeyManage) && r.Can(perms...)
+}
+
+// APIKey lets a merchant's own systems call the API without a password. It
+// is stored by the SHA-256 of its value; Prefix is kept to tell keys apart.
+type APIKey struct {
+	ID         uint   `gorm:"primarykey"`
+	Owner      string `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null"`
+	KeyHash    string `gorm:"unique;not null"`
+	Scopes     string `gorm:"not null"` // comma separated
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIP *string
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+func (k APIKey) ScopeList() []Scope {
+	scopes := make([]Scope, 0)
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s != "" {
+			scopes = append(scopes, Scope(s))
+		}
+	}
+	return scopes
+}
+
+// HasScopes reports whether the key carries every one of scopes.
+func (k APIKey) HasScopes(scopes ...Scope) bool {
+	list := k.ScopeList()
+	for _, s := range scopes {
+		if !slices.Contains(list, s) {
+			return false
+		}
+	}
+	return true
+}
+
+type CreateAPIKeyValidation struct {
+	Name      string     `json:"name" validate:"required,max=64"`
+	Scopes    []Scope    `json:"scopes" validate:"required,min=1,dive,oneof=products:write orders:read orders:write"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
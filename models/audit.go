@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+const (
+	AuditLoginLockout = "LOGIN_LOCKOUT"
+	AuditLoginUnlock  = "LOGIN_UNLOCK"
+)
+
+// AuditEvent records a security relevant event. Actor is the user who
+// caused it, nil for the system; Subject is what it happened to.
+type AuditEvent struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Action    string    `json:"action" gorm:"not null;index"`
+	Actor     *string   `json:"actor"`
+	Subject   string    `json:"subject" gorm:"not null;index"`
+	IP        string    `json:"ip"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginThrottle counts the failed logins of one username ("user:<name>") or
+// client address ("ip:<addr>"). Past the allowed attempts each failure locks
+// the key for twice as long as the one before.
+type LoginThrottle struct {
+	Key          string    `gorm:"primarykey"`
+	Failures     int       `gorm:"not null;default:0"`
+	LastFailedAt time.Time `gorm:"not null"`
+	LockedUntil  *time.Time
+	UpdatedAt    time.Time
+}
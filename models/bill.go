@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// BillInquiry is the amount due a biller reported for a customer. It is
+// paid once, before ExpiresAt, by the user who made it.
+type BillInquiry struct {
+	gorm.Model
+	Reference      string    `json:"reference" gorm:"unique;not null"`
+	Owner          string    `json:"owner" gorm:"not null;index"`
+	ProductCode    string    `json:"product_code" gorm:"not null"`
+	Biller         string    `json:"biller" gorm:"not null"`
+	CustomerNumber string    `json:"customer_number" gorm:"not null"`
+	CustomerName   string    `json:"customer_name" gorm:"not null"`
+	Amount         Money     `json:"amount" gorm:"type:bigint;not null"`
+	Currency       Currency  `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
+	Period         string    `json:"period"`
+	ExpiresAt      time.Time `json:"expires_at" gorm:"not null"`
+	OrderID        *uint     `json:"order_id"`
+}
+
+type BillInquiryValidation struct {
+	Code           string `json:"code" validate:"required"`
+	CustomerNumber string `json:"customer_number" validate:"required,numeric,max=32"`
+}
+
+type PayBillValidation struct {
+	Reference string `json:"reference" validate:"required"`
+}
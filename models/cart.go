@@ -0,0 +1,30 @@
+package models
+
+import "gorm.io/gorm"
+
+type Cart struct {
+	gorm.Model
+	Owner string     `json:"owner" gorm:"unique;not null"`
+	Items []CartItem `json:"items"`
+
+	User User `gorm:"foreignKey:Owner;references:Username"`
+}
+
+type CartItem struct {
+	gorm.Model
+	CartID      uint   `json:"cart_id" gorm:"not null;uniqueIndex:idx_cart_item_variant"`
+	ProductCode string `json:"product_code" gorm:"not null;uniqueIndex:idx_cart_item_variant"`
+	// VariantSKU is empty for products without variants.
+	VariantSKU string `json:"variant_sku" gorm:"not null;default:'';uniqueIndex:idx_cart_item_variant"`
+	Qty        int    `json:"qty" gorm:"not null"`
+}
+
+type AddCartItemValidation struct {
+	Code string `json:"code" validate:"required_without=SKU"`
+	SKU  string `json:"sku"`
+	Qty  int    `json:"qty" validate:"required,gt=0"`
+}
+
+type UpdateCartItemValidation struct {
+	Qty int `json:"qty" validate:"required,gt=0"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Category groups products in a tree. Categories are deleted outright so a
+// slug can be reused once its category is gone.
+type Category struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	Name      string    `json:"name" gorm:"not null"`
+	Slug      string    `json:"slug" gorm:"unique;not null"`
+	ParentID  *uint     `json:"-" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Parent   *Category  `json:"-" gorm:"constraint:OnDelete:RESTRICT"`
+	Children []Category `json:"-" gorm:"foreignKey:ParentID"`
+}
+
+// CreateCategoryValidation creates a category under Parent, given by slug.
+// Slug is derived from Name when empty.
+type CreateCategoryValidation struct {
+	Name   string  `json:"name" validate:"required,min=3"`
+	Slug   string  `json:"slug" validate:"omitempty,slug"`
+	Parent *string `json:"parent"`
+}
+
+// UpdateCategoryValidation renames or moves a category. An empty Parent
+// moves it to the top level.
+type UpdateCategoryValidation struct {
+	Name   string  `json:"name" validate:"required,min=3"`
+	Slug   string  `json:"slug" validate:"required,slug"`
+	Parent *string `json:"parent"`
+}
+
+type SetProductCategoriesValidation struct {
+	Categories []string `json:"categories" validate:"required,dive,required"`
+}
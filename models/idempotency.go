@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// IdempotencyKey is the stored outcome of a request sent with an
+// Idempotency-Key header. StatusCode stays 0 while the first request is
+// still being processed, which it holds the key for until LockedUntil; a
+// retry after that, say when the process died mid-request, takes over.
+type IdempotencyKey struct {
+	ID           uint   `gorm:"primarykey"`
+	Owner        string `gorm:"not null;uniqueIndex:idx_idempotency_owner_key"`
+	Key          string `gorm:"not null;uniqueIndex:idx_idempotency_owner_key"`
+	RequestHash  string `gorm:"not null"`
+	StatusCode   int    `gorm:"not null;default:0"`
+	ContentType  string `gorm:"not null;default:''"`
+	ResponseBody []byte `gorm:"type:bytea"`
+	LockedUntil  *time.Time
+	ExpiresAt    time.Time `gorm:"not null;index"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// InvoiceCounter is the last sequence number handed out for a namespace in
+// a period (the formatted invoice date, or empty when the invoice format
+// has no date).
+type InvoiceCounter struct {
+	Namespace string `gorm:"primaryKey"`
+	Period    string `gorm:"primaryKey"`
+	Value     int64  `gorm:"not null"`
+	UpdatedAt time.Time
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type Direction string
+
+const (
+	Debit  Direction = "DEBIT"
+	Credit Direction = "CREDIT"
+)
+
+func (d *Direction) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*d = Direction(v)
+	case string:
+		*d = Direction(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (d Direction) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+// JournalEntry groups the postings of one business event. The debits and
+// credits of an entry always sum to the same amount.
+type JournalEntry struct {
+	gorm.Model
+	Reference   string  `json:"reference" gorm:"not null;index"`
+	Description *string `json:"description" gorm:"type:text"`
+
+	Postings []Posting `json:"postings"`
+}
+
+// Posting moves Amount into (CREDIT) or out of (DEBIT) either a user account
+// or a named system account such as the external funding source.
+type Posting struct {
+	gorm.Model
+	JournalEntryID uint      `json:"journal_entry_id" gorm:"not null;index"`
+	AccountID      *uint     `json:"account_id" gorm:"index"`
+	SystemAccount  *string   `json:"system_account"`
+	OrderID        *uint     `json:"order_id" gorm:"index"`
+	Direction      Direction `json:"direction" gorm:"not null; type:posting_direction"`
+	Amount         Money     `json:"amount" gorm:"type:bigint;not null"`
+	Currency       Currency  `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
+
+	Account *Account `gorm:"foreignKey:AccountID;references:ID"`
+	Order   *Order   `gorm:"foreignKey:OrderID;references:ID"`
+}
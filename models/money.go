@@ -0,0 +1,201 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// MinorUnits is the number of minor units (sen) in one major unit (rupiah).
+const MinorUnits = 100
+
+// Money is an exact amount of money stored as integer minor units, so
+// 40000.50 is kept as 4000050. It is persisted as bigint and marshalled to
+// JSON as a decimal number with two fraction digits.
+type Money int64
+
+type Currency string
+
+// ErrMoneyOverflow is returned by arithmetic whose result does not fit in
+// Money.
+var ErrMoneyOverflow = errors.New("money amount out of range")
+
+const (
+	IDR Currency = "IDR"
+)
+
+// NewMoney returns the Money value of a whole major-unit amount.
+func NewMoney(major int64) Money {
+	return Money(major * MinorUnits)
+}
+
+// ParseMoney parses a decimal string such as "40000", "40000.5" or
+// "-12.34" without going through floating point. More than two fraction
+// digits is an error rather than a silent rounding.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid money amount %q", s)
+	}
+
+	negative := false
+	if s[0] == '-' || s[0] == '+' {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || (hasFrac && frac == "") || len(frac) > 2 {
+		return 0, fmt.Errorf("invalid money amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	major, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid money amount %q", s)
+	}
+	minor, err := strconv.ParseUint(frac, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid money amount %q", s)
+	}
+	if major > (math.MaxInt64-minor)/MinorUnits {
+		return 0, fmt.Errorf("money amount %q out of range", s)
+	}
+
+	m := Money(major*MinorUnits + minor)
+	if negative {
+		m = -m
+	}
+
+	return m, nil
+}
+
+// Mul returns m multiplied by qty, or ErrMoneyOverflow when the product
+// does not fit.
+func (m Money) Mul(qty int) (Money, error) {
+	hi, lo := bits.Mul64(abs(int64(m)), abs(int64(qty)))
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, ErrMoneyOverflow
+	}
+	if (m < 0) != (qty < 0) {
+		return -Money(lo), nil
+	}
+	return Money(lo), nil
+}
+
+// Add returns m plus n, or ErrMoneyOverflow when the sum does not fit.
+func (m Money) Add(n Money) (Money, error) {
+	sum := m + n
+	if (n > 0 && sum < m) || (n < 0 && sum > m) {
+		return 0, ErrMoneyOverflow
+	}
+	return sum, nil
+}
+
+func abs(v int64) uint64 {
+	if v < 0 {
+		return uint64(-v)
+	}
+	return uint64(v)
+}
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+	}
+	// through uint64, as -math.MinInt64 is still negative
+	v := abs(int64(m))
+	return fmt.Sprintf("%s%d.%02d", sign, v/MinorUnits, v%MinorUnits)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts both a JSON number and a quoted decimal string.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return fmt.Errorf("invalid money amount %s", s)
+		}
+		s = unquoted
+	} else if strings.ContainsAny(s, `" `) {
+		return fmt.Errorf("invalid money amount %s", s)
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// UnmarshalYAML reads an amount written like ParseMoney expects.
+func (m *Money) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+func (m *Money) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		*m = Money(v)
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	default:
+		return fmt.Errorf("expected int64, []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (m *Money) scanString(s string) error {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid money value %q", s)
+	}
+	*m = Money(v)
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+func (c *Currency) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*c = Currency(v)
+	case string:
+		*c = Currency(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (c Currency) Value() (driver.Value, error) {
+	return string(c), nil
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMoneyMul(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Money
+		qty  int
+		want Money
+		err  error
+	}{
+		{"simple", NewMoney(40000), 3, NewMoney(120000), nil},
+		{"zero qty", NewMoney(40000), 0, 0, nil},
+		{"negative", Money(-150), 2, Money(-300), nil},
+		{"max", Money(math.MaxInt64), 1, Money(math.MaxInt64), nil},
+		{"overflow", Money(math.MaxInt64/2 + 1), 2, 0, ErrMoneyOverflow},
+		{"large qty", NewMoney(1000000000), math.MaxInt32, 0, ErrMoneyOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.Mul(tt.qty)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Mul(%d) error = %v, want %v", tt.qty, err, tt.err)
+			}
+			if got != tt.want {
+				t.Fatalf("Mul(%d) = %s, want %s", tt.qty, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyAdd(t *testing.T) {
+	if got, err := NewMoney(1).Add(Money(50)); err != nil || got != Money(150) {
+		t.Fatalf("Add = %s, %v, want 1.50", got, err)
+	}
+	if _, err := Money(math.MaxInt64).Add(1); !errors.Is(err, ErrMoneyOverflow) {
+		t.Fatalf("Add past max error = %v, want ErrMoneyOverflow", err)
+	}
+	if _, err := Money(math.MinInt64).Add(-1); !errors.Is(err, ErrMoneyOverflow) {
+		t.Fatalf("Add past min error = %v, want ErrMoneyOverflow", err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{Money(5), "0.05"},
+		{Money(-5), "-0.05"},
+		{NewMoney(40000), "40000.00"},
+		{Money(-4000050), "-40000.50"},
+		{Money(math.MaxInt64), "92233720368547758.07"},
+		{Money(math.MinInt64), "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("String(%d) = %s, want %s", int64(tt.m), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{`40000`, NewMoney(40000), false},
+		{`40000.5`, Money(4000050), false},
+		{`"40000.50"`, Money(4000050), false},
+		{`"40000`, 0, true},
+		{`40000"`, 0, true},
+		{`""`, 0, true},
+		{`"40000.505"`, 0, true},
+		{`"abc"`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var m Money
+			err := m.UnmarshalJSON([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalJSON(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if m != tt.want {
+				t.Fatalf("UnmarshalJSON(%s) = %s, want %s", tt.in, m, tt.want)
+			}
+		})
+	}
+
+	var body struct {
+		Amount Money `json:"amount"`
+	}
+	if err := json.Unmarshal([]byte(`{"amount": "12.34"}`), &body); err != nil || body.Amount != Money(1234) {
+		t.Fatalf("json.Unmarshal = %s, %v, want 12.34", body.Amount, err)
+	}
+}
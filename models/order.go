@@ -13,6 +13,13 @@ const (
 	Topup   Type = "TOPUP"
 	Payment Type = "PAYMENT"
 	Revenue Type = "REVENUE"
+	Refund  Type = "REFUND"
+
+	TransferOut Type = "TRANSFER_OUT"
+	TransferIn  Type = "TRANSFER_IN"
+
+	// Adjustment is a balance correction made by staff.
+	Adjustment Type = "ADJUSTMENT"
 )
 
 func (t *Type) Scan(value interface{}) error {
@@ -33,22 +40,73 @@ func (t Type) Value() (driver.Value, error) {
 
 type Order struct {
 	gorm.Model
-	Invoice     string  `json:"invoice" gorm:"unique;not null"`
-	AccountID   uint    `json:"account_id" gorm:"not null"`
-	Merchant    *string `json:"merchant" `
-	Buyer       *string `json:"buyer" `
-	Amount      float64 `json:"amount" gorm:"type:numeric(10,2);not null"`
-	Type        Type    `json:"type" gorm:"not null; type:order_type"`
-	Description *string `json:"description" gorm:"type:text"`
+	Invoice    string      `json:"invoice" gorm:"unique;not null"`
+	AccountID  uint        `json:"account_id" gorm:"not null"`
+	Merchant   *string     `json:"merchant" `
+	Buyer      *string     `json:"buyer" `
+	Amount     Money       `json:"amount" gorm:"type:bigint;not null"`
+	Currency   Currency    `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
+	Type       Type        `json:"type" gorm:"not null; type:order_type"`
+	Status     OrderStatus `json:"status" gorm:"not null;type:order_status;default:'COMPLETED'"`
+	PurchaseID *uint       `json:"purchase_id" gorm:"index"`
+	// SubscriptionID is set on the PAYMENT orders of subscription charges.
+	SubscriptionID *uint   `json:"subscription_id" gorm:"index"`
+	Reference      *string `json:"reference" gorm:"index"`
+	Description    *string `json:"description" gorm:"type:text"`
+	// BillerReference and BillerToken are the biller's receipt for a bill
+	// payment, the token being set for prepaid products.
+	BillerReference *string `json:"biller_reference"`
+	BillerToken     *string `json:"biller_token"`
+
+	Account  Account     `gorm:"foreignKey:AccountID;references:ID"`
+	Purchase *Order      `json:"-" gorm:"foreignKey:PurchaseID;references:ID"`
+	Items    []OrderItem `json:"items"`
+}
 
-	Account Account `gorm:"foreignKey:AccountID;references:ID"`
+// OrderItem is one line of a PAYMENT order. Name and price are a snapshot
+// taken at checkout, so later product changes do not alter past orders.
+type OrderItem struct {
+	gorm.Model
+	OrderID     uint     `json:"order_id" gorm:"not null;index"`
+	ProductCode string   `json:"product_code" gorm:"not null"`
+	ProductName string   `json:"product_name" gorm:"not null"`
+	VariantSKU  *string  `json:"variant_sku"`
+	Merchant    string   `json:"merchant" gorm:"not null"`
+	UnitPrice   Money    `json:"unit_price" gorm:"type:bigint;not null"`
+	Currency    Currency `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
+	Qty         int      `json:"qty" gorm:"not null"`
+	Subtotal    Money    `json:"subtotal" gorm:"type:bigint;not null"`
+}
+
+// AdjustBalanceValidation is a staff balance correction, credited when
+// Amount is positive and debited when it is negative.
+type AdjustBalanceValidation struct {
+	Amount Money  `json:"amount" validate:"required,ne=0"`
+	Reason string `json:"reason" validate:"required,max=255"`
 }
 
 type TopupValidation struct {
-	Amount float64 `json:"amount" validate:"required,gt=0"`
+	Amount Money `json:"amount" validate:"required,gt=0"`
+}
+
+// RefundValidation refunds a purchase by its buyer or merchant invoice. A
+// nil Amount refunds everything not refunded yet.
+type RefundValidation struct {
+	Invoice  string  `json:"invoice" validate:"required"`
+	Amount   *Money  `json:"amount" validate:"omitempty,gt=0"`
+	Reason   *string `json:"reason"`
+	Override bool    `json:"override"`
+}
+
+type TransferValidation struct {
+	Recipient string  `json:"recipient" validate:"required"`
+	Amount    Money   `json:"amount" validate:"required,gt=0"`
+	Note      *string `json:"note" validate:"omitempty,max=255"`
 }
 
+// PaymentValidation buys a product by Code, or one of its variants by SKU.
 type PaymentValidation struct {
-	Code string `json:"code" validate:"required"`
+	Code string `json:"code" validate:"required_without=SKU"`
+	SKU  string `json:"sku"`
 	Qty  int    `json:"qty" validate:"required,gt=0"`
 }
@@ -0,0 +1,45 @@
+package models
+
+import "slices"
+
+// Permission names something a role may do. ":own" permissions cover the
+// user's own records, ":any" everyone's.
+type Permission string
+
+const (
+	ProductWriteOwn Permission = "product:write:own"
+	ProductWriteAny Permission = "product:write:any"
+	CategoryWrite   Permission = "category:write"
+	OrderManageAny  Permission = "order:manage:any"
+	RefundOverride  Permission = "refund:override"
+	AccountAdjust   Permission = "account:adjust"
+	LedgerCheck     Permission = "ledger:check"
+	UserRead        Permission = "user:read"
+	UserSuspend     Permission = "user:suspend"
+	UserRoleWrite   Permission = "user:role"
+	APIKeyManage    Permission = "apikey:manage"
+)
+
+var rolePermissions = map[Role][]Permission{
+	Client:   {},
+	Merchant: {ProductWriteOwn, APIKeyManage},
+	Admin: {
+		ProductWriteOwn, ProductWriteAny, CategoryWrite, OrderManageAny, RefundOverride,
+		AccountAdjust, LedgerCheck, UserRead, UserSuspend, UserRoleWrite, APIKeyManage,
+	},
+}
+
+// Permissions lists what r may do.
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+// Can reports whether r has every one of perms.
+func (r Role) Can(perms ...Permission) bool {
+	for _, p := range perms {
+		if !slices.Contains(rolePermissions[r], p) {
+			return false
+		}
+	}
+	return true
+}
@@ -8,22 +8,82 @@ type Product struct {
 	gorm.Model
 	Code     string   `json:"code" gorm:"unique;not null"`
 	Name     string   `json:"name" gorm:"not null"`
-	Price    float64  `json:"price" gorm:"type:numeric(10,2);not null"`
+	Price    Money    `json:"price" gorm:"type:bigint;not null"`
+	Currency Currency `json:"currency" gorm:"type:varchar(3);not null;default:'IDR'"`
 	Weight   *float64 `json:"weight" gorm:"type:numeric(3,2)"`
 	Merchant string   `json:"merchant" gorm:"not null"`
+	// Stock is nil for products that are not stock tracked, such as bills.
+	Stock             *int `json:"stock" gorm:"check:stock >= 0"`
+	LowStockThreshold int  `json:"low_stock_threshold" gorm:"not null;default:0"`
+	// Biller names the biller adapter of a bill-payment product. Bills are
+	// paid through inquiry, not bought from the catalog.
+	Biller *string `json:"biller" gorm:"type:varchar(32)"`
+	// Subscribable products can be charged every billing interval.
+	Subscribable bool `json:"subscribable" gorm:"not null;default:false"`
 
-	User User `gorm:"foreignKey:Merchant;references:Username"`
+	User       User       `gorm:"foreignKey:Merchant;references:Username"`
+	Categories []Category `gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
+	Variants   []ProductVariant
+}
+
+// IsLowStock reports whether a stock-tracked product is at or below its
+// low-stock threshold.
+func (p Product) IsLowStock() bool {
+	return p.Stock != nil && *p.Stock <= p.LowStockThreshold
+}
+
+// StockMovement records every change to a product's stock with its reason.
+type StockMovement struct {
+	gorm.Model
+	ProductCode string  `json:"product_code" gorm:"not null;index"`
+	VariantSKU  *string `json:"variant_sku" gorm:"index"`
+	Delta       int     `json:"delta" gorm:"not null"`
+	StockAfter  int     `json:"stock_after" gorm:"not null"`
+	Reason      string  `json:"reason" gorm:"not null"`
+	Actor       string  `json:"actor" gorm:"not null"`
+	OrderID     *uint   `json:"order_id" gorm:"index"`
+	Note        *string `json:"note" gorm:"type:text"`
 }
 
 type CreateProductValidation struct {
-	Code   string   `json:"code" validate:"required,min=3"`
-	Name   string   `json:"name" validate:"required,min=3"`
-	Price  float64  `json:"price" validate:"required,gt=0"`
-	Weight *float64 `json:"weight" validate:"gt=0"`
+	Code              string   `json:"code" validate:"required,min=3"`
+	Name              string   `json:"name" validate:"required,min=3"`
+	Price             Money    `json:"price" validate:"required,gt=0"`
+	Weight            *float64 `json:"weight" validate:"gt=0"`
+	Stock             *int     `json:"stock" validate:"omitempty,gte=0"`
+	LowStockThreshold int      `json:"low_stock_threshold" validate:"gte=0"`
+	Subscribable      bool     `json:"subscribable"`
 }
 
 type UpdateProductValidation struct {
 	Name   string   `json:"name" validate:"required,min=3"`
-	Price  float64  `json:"price" validate:"required,gt=0"`
+	Price  Money    `json:"price" validate:"required,gt=0"`
 	Weight *float64 `json:"weight" validate:"gt=0"`
 }
+
+// AdjustStockValidation changes stock by Delta. Reason is one of the
+// movement reasons merchants may record by hand.
+type AdjustStockValidation struct {
+	// SKU adjusts the stock of one variant instead of the product.
+	SKU               string  `json:"sku"`
+	Delta             int     `json:"delta" validate:"required"`
+	Reason            string  `json:"reason" validate:"required,oneof=restock correction damaged lost returned"`
+	Note              *string `json:"note"`
+	LowStockThreshold *int    `json:"low_stock_threshold" validate:"omitempty,gte=0"`
+}
+
+// ProductQuery filters, sorts and pages GET /api/products. Prices are
+// decimal strings, parsed with ParseMoney.
+type ProductQuery struct {
+	Q        string `query:"q"`
+	Merchant string `query:"merchant"`
+	// Category matches products of the category with that slug or any of
+	// its subcategories.
+	Category string `query:"category"`
+	MinPrice string `query:"min_price"`
+	MaxPrice string `query:"max_price"`
+	Sort     string `query:"sort" validate:"omitempty,oneof=price name created_at"`
+	Order    string `query:"order" validate:"omitempty,oneof=asc desc"`
+	Cursor   string `query:"cursor"`
+	Limit    int    `query:"limit" validate:"gte=0,lte=100"`
+}
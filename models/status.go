@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+type OrderStatus string
+
+const (
+	Pending   OrderStatus = "PENDING"
+	Paid      OrderStatus = "PAID"
+	Fulfilled OrderStatus = "FULFILLED"
+	Completed OrderStatus = "COMPLETED"
+	Cancelled OrderStatus = "CANCELLED"
+	Refunded  OrderStatus = "REFUNDED"
+)
+
+// orderTransitions lists the statuses each status may move to. CANCELLED
+// and REFUNDED are final. A paid order may be cancelled, which refunds it,
+// until it is fulfilled; after that it is undone by refunding it.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	Pending:   {Paid, Cancelled},
+	Paid:      {Fulfilled, Cancelled, Refunded},
+	Fulfilled: {Completed, Refunded},
+	Completed: {Refunded},
+}
+
+// CanTransition reports whether an order in status s may move to next.
+func (s OrderStatus) CanTransition(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *OrderStatus) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*s = OrderStatus(v)
+	case string:
+		*s = OrderStatus(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (s OrderStatus) Value() (driver.Value, error) {
+	return string(s), nil
+}
+
+// OrderStatusHistory is an append-only record of every status an order has
+// been in. FromStatus is nil for the status an order was created with.
+type OrderStatusHistory struct {
+	ID         uint         `json:"-" gorm:"primarykey"`
+	OrderID    uint         `json:"-" gorm:"not null;index"`
+	FromStatus *OrderStatus `json:"from_status" gorm:"type:order_status"`
+	ToStatus   OrderStatus  `json:"to_status" gorm:"not null;type:order_status"`
+	Actor      string       `json:"actor" gorm:"not null"`
+	Note       *string      `json:"note" gorm:"type:text"`
+	CreatedAt  time.Time    `json:"created_at"`
+
+	Order Order `json:"-" gorm:"foreignKey:OrderID;references:ID"`
+}
+
+type UpdateOrderStatusValidation struct {
+	Status OrderStatus `json:"status" validate:"required,oneof=FULFILLED COMPLETED CANCELLED"`
+	Note   *string     `json:"note"`
+}
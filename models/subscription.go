@@ -0,0 +1,131 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive    SubscriptionStatus = "ACTIVE"
+	SubscriptionPastDue   SubscriptionStatus = "PAST_DUE"
+	SubscriptionPaused    SubscriptionStatus = "PAUSED"
+	SubscriptionCancelled SubscriptionStatus = "CANCELLED"
+)
+
+func (s *SubscriptionStatus) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*s = SubscriptionStatus(v)
+	case string:
+		*s = SubscriptionStatus(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (s SubscriptionStatus) Value() (driver.Value, error) {
+	return string(s), nil
+}
+
+type BillingInterval string
+
+const (
+	Daily   BillingInterval = "DAILY"
+	Weekly  BillingInterval = "WEEKLY"
+	Monthly BillingInterval = "MONTHLY"
+	Yearly  BillingInterval = "YEARLY"
+)
+
+func (i *BillingInterval) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*i = BillingInterval(v)
+	case string:
+		*i = BillingInterval(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (i BillingInterval) Value() (driver.Value, error) {
+	return string(i), nil
+}
+
+// Next returns the charge date one interval after t. Monthly and yearly
+// charges stay on the day of anchor, the date of the first charge, and fall
+// on the last day of shorter months.
+func (i BillingInterval) Next(t, anchor time.Time) time.Time {
+	switch i {
+	case Daily:
+		return t.AddDate(0, 0, 1)
+	case Weekly:
+		return t.AddDate(0, 0, 7)
+	}
+
+	months := 1
+	if i == Yearly {
+		months = 12
+	}
+	year, month, _ := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := anchor.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// Subscription charges the owner for a product every interval. A charge is
+// due at NextChargeAt, or at RetryAt while a failed charge is retried.
+type Subscription struct {
+	gorm.Model
+	Owner       string          `json:"owner" gorm:"not null;index"`
+	ProductCode string          `json:"product_code" gorm:"not null"`
+	VariantSKU  *string         `json:"variant_sku"`
+	Interval    BillingInterval `json:"interval" gorm:"not null;type:billing_interval"`
+	// CustomerNumber is the biller's customer for bill products.
+	CustomerNumber *string            `json:"customer_number"`
+	Status         SubscriptionStatus `json:"status" gorm:"not null;type:subscription_status;index"`
+	AnchorAt       time.Time          `json:"anchor_at" gorm:"not null"`
+	NextChargeAt   time.Time          `json:"next_charge_at" gorm:"not null;index"`
+	RetryAt        *time.Time         `json:"retry_at"`
+	FailedAttempts int                `json:"failed_attempts" gorm:"not null;default:0"`
+	LastError      *string            `json:"last_error"`
+	CancelledAt    *time.Time         `json:"cancelled_at"`
+
+	User User `json:"-" gorm:"foreignKey:Owner;references:Username"`
+}
+
+// SubscriptionCharge records every attempt to charge a subscription. OrderID
+// is the PAYMENT order of a successful charge.
+type SubscriptionCharge struct {
+	ID             uint      `json:"-" gorm:"primarykey"`
+	SubscriptionID uint      `json:"-" gorm:"not null;index"`
+	Attempt        int       `json:"attempt" gorm:"not null"`
+	Amount         *Money    `json:"amount" gorm:"type:bigint"`
+	OrderID        *uint     `json:"order_id"`
+	Error          *string   `json:"error"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type SubscribeValidation struct {
+	Code           string          `json:"code" validate:"required_without=SKU"`
+	SKU            string          `json:"sku"`
+	Interval       BillingInterval `json:"interval" validate:"required,oneof=DAILY WEEKLY MONTHLY YEARLY"`
+	CustomerNumber *string         `json:"customer_number" validate:"omitempty,numeric,max=32"`
+}
+
+// ChangePlanValidation switches a subscription to another product, variant
+// or interval from its next charge on.
+type ChangePlanValidation struct {
+	Code     string          `json:"code" validate:"required_without=SKU"`
+	SKU      string          `json:"sku"`
+	Interval BillingInterval `json:"interval" validate:"required,oneof=DAILY WEEKLY MONTHLY YEARLY"`
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// RefreshToken is one issued refresh token, stored by the SHA-256 of its
+// value. Each refresh rotates it into a new token of the same family, so a
+// token used a second time means it leaked and the whole family is revoked.
+// AccessJTI is the access token issued alongside it, denied on revocation.
+type RefreshToken struct {
+	ID              uint      `gorm:"primarykey"`
+	Owner           string    `gorm:"not null;index"`
+	FamilyID        string    `gorm:"not null;index"`
+	TokenHash       string    `gorm:"unique;not null"`
+	AccessJTI       string    `gorm:"not null;index"`
+	AccessExpiresAt time.Time `gorm:"not null"`
+	ExpiresAt       time.Time `gorm:"not null"`
+	RotatedAt       *time.Time
+	RevokedAt       *time.Time
+	CreatedAt       time.Time
+}
+
+// RevokedToken denies an access token by its jti until it would have
+// expired anyway.
+type RevokedToken struct {
+	JTI       string    `gorm:"primarykey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+type TokenPurpose string
+
+const (
+	VerifyEmail   TokenPurpose = "VERIFY_EMAIL"
+	ResetPassword TokenPurpose = "RESET_PASSWORD"
+)
+
+func (p *TokenPurpose) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		*p = TokenPurpose(v)
+	case string:
+		*p = TokenPurpose(v)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+	return nil
+}
+
+func (p TokenPurpose) Value() (driver.Value, error) {
+	return string(p), nil
+}
+
+// EmailToken is a single-use token mailed to Email, stored by the SHA-256
+// of its value. Verification tokens only verify the address they were sent
+// to, so changing the email voids them.
+type EmailToken struct {
+	ID        uint         `gorm:"primarykey"`
+	Owner     string       `gorm:"not null;index"`
+	Purpose   TokenPurpose `gorm:"not null;type:token_purpose"`
+	Email     string       `gorm:"not null"`
+	TokenHash string       `gorm:"unique;not null"`
+	ExpiresAt time.Time    `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type RefreshValidation struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
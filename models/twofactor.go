@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// RecoveryCode is a one-time code that stands in for an authenticator code,
+// stored by the SHA-256 of its value.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primarykey"`
+	Owner     string `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TwoFactorChallenge is a login that passed the password check and waits
+// for the second factor. It is stored by the SHA-256 of its token.
+type TwoFactorChallenge struct {
+	ID        uint      `gorm:"primarykey"`
+	Owner     string    `gorm:"not null;index"`
+	TokenHash string    `gorm:"unique;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type TwoFactorCodeValidation struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type VerifyTwoFactorValidation struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"required,max=32"`
+}
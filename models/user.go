@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql/driver"
 	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -12,6 +13,7 @@ type Role string
 const (
 	Client   Role = "CLIENT"
 	Merchant Role = "MERCHANT"
+	Admin    Role = "ADMIN"
 )
 
 func (t *Role) Scan(value interface{}) error {
@@ -32,20 +34,73 @@ func (t Role) Value() (driver.Value, error) {
 
 type User struct {
 	gorm.Model
-	Username string   `json:"username" gorm:"unique;not null"`
-	Password string   `json:"password" gorm:"not null"`
-	Role     Role     `json:"role" gorm:"not null; type:role"`
-	
-	Account  *Account `gorm:"foreignKey:Owner;references:Username"`
+	Username string `json:"username" gorm:"unique;not null"`
+	Password string `json:"password" gorm:"not null"`
+	Role     Role   `json:"role" gorm:"not null; type:role"`
+	// Email is stored lower case and receives password resets once
+	// EmailVerifiedAt is set. Phone is contact detail only, not verified.
+	Email           *string    `json:"email" gorm:"unique"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Phone           *string    `json:"phone"`
+	// SuspendedAt is set while staff have suspended the user, who then
+	// cannot log in.
+	SuspendedAt   *time.Time `json:"suspended_at"`
+	SuspendReason *string    `json:"suspend_reason"`
+	// TOTPSecret is set from enrollment on, and TOTPEnabledAt once a code
+	// confirmed it. TOTPLastStep is the step of the last accepted code,
+	// which cannot be used again.
+	TOTPSecret         *string    `json:"-"`
+	TOTPEnabledAt      *time.Time `json:"totp_enabled_at"`
+	TOTPLastStep       int64      `json:"-" gorm:"not null;default:0"`
+	TOTPFailedAttempts int        `json:"-" gorm:"not null;default:0"`
+	TOTPLockedUntil    *time.Time `json:"-"`
+
+	Account *Account `gorm:"foreignKey:Owner;references:Username"`
 }
 
 type RegisterValidation struct {
 	Username string `json:"username" validate:"required,min=6"`
 	Password string `json:"password" validate:"required,min=6"`
 	Role     Role   `json:"role" validate:"required,role"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Phone    string `json:"phone" validate:"omitempty,e164"`
 }
 
 type LoginValidation struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
+
+type ChangeEmailValidation struct {
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ForgotPasswordValidation struct {
+	Email string `json:"email" validate:"required,email,max=254"`
+}
+
+type ResetPasswordValidation struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=6"`
+}
+
+type VerifyEmailValidation struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ChangeRoleValidation struct {
+	Role Role `json:"role" validate:"required,oneof=CLIENT MERCHANT ADMIN"`
+}
+
+type SuspendUserValidation struct {
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+// UserQuery filters and pages GET /api/admin/users.
+type UserQuery struct {
+	Q      string `query:"q"`
+	Role   Role   `query:"role" validate:"omitempty,oneof=CLIENT MERCHANT ADMIN"`
+	Limit  int    `query:"limit" validate:"gte=0,lte=100"`
+	Offset int    `query:"offset" validate:"gte=0"`
+}
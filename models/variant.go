@@ -0,0 +1,66 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"maps"
+
+	"gorm.io/gorm"
+)
+
+// Options are the option values that set a variant apart, such as
+// nominal=50k and operator=Telkomsel. They are stored as jsonb.
+type Options map[string]string
+
+func (o *Options) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, o)
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	default:
+		return fmt.Errorf("expected []byte or string, got %T", value)
+	}
+}
+
+func (o Options) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(o)
+	return string(b), err
+}
+
+// Equal reports whether o and other hold the same option values.
+func (o Options) Equal(other Options) bool {
+	return maps.Equal(o, other)
+}
+
+// ProductVariant is a sellable denomination of a product with its own SKU,
+// price and stock. A product with variants is bought by variant SKU.
+type ProductVariant struct {
+	gorm.Model
+	ProductID uint `json:"product_id" gorm:"not null;index"`
+	// unique among live variants, so a deleted variant's SKU can be reused
+	SKU     string  `json:"sku" gorm:"not null;uniqueIndex:idx_product_variants_sku,where:deleted_at IS NULL"`
+	Name    string  `json:"name" gorm:"not null"`
+	Price   Money   `json:"price" gorm:"type:bigint;not null"`
+	Options Options `json:"options" gorm:"type:jsonb;not null;default:'{}'"`
+	// Stock is nil for variants that are not stock tracked.
+	Stock *int `json:"stock" gorm:"check:stock >= 0"`
+}
+
+type CreateVariantValidation struct {
+	SKU     string  `json:"sku" validate:"required,min=3"`
+	Name    string  `json:"name" validate:"required"`
+	Price   Money   `json:"price" validate:"required,gt=0"`
+	Options Options `json:"options" validate:"required,min=1,dive,keys,required,endkeys,required"`
+	Stock   *int    `json:"stock" validate:"omitempty,gte=0"`
+}
+
+type UpdateVariantValidation struct {
+	Name    string  `json:"name" validate:"required"`
+	Price   Money   `json:"price" validate:"required,gt=0"`
+	Options Options `json:"options" validate:"required,min=1,dive,keys,required,endkeys,required"`
+}
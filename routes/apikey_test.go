@@ -0,0 +1,58 @@
+package routes_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+// apiKey creates a key of the user token belongs to with scopes and returns
+// it.
+func (a *testApp) apiKey(t *testing.T, token string, scopes ...models.Scope) string {
+	t.Helper()
+	var created struct {
+		Key string `json:"key"`
+	}
+	if status := a.do(t, http.MethodPost, "/api/keys", token, fiber.Map{"name": "back office", "scopes": scopes}, &created); status != 201 {
+		t.Fatalf("create API key: status %d", status)
+	}
+	return created.Key
+}
+
+// getWithKey sends a GET to path authenticated by key alone.
+func (a *testApp) getWithKey(t *testing.T, path, key string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set(fiber.HeaderXForwardedFor, a.ip)
+	req.Header.Set("X-API-Key", key)
+	res, err := a.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestHistoryWithAPIKey(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	_, client := a.signup(t, "CLIENT")
+
+	a.topup(t, client, models.NewMoney(100000))
+	a.pay(t, client, a.createProduct(t, merchant, models.NewMoney(10000), 5), 1)
+
+	if status := a.getWithKey(t, "/api/transaction/history", a.apiKey(t, merchant, models.OrdersRead)); status != 200 {
+		t.Fatalf("history with an orders:read key: status %d", status)
+	}
+	if status := a.getWithKey(t, "/api/transaction/history", a.apiKey(t, merchant, models.ProductsWrite)); status != 401 {
+		t.Fatalf("history with a products:write key: status %d, want 401", status)
+	}
+	// the rest of the group still takes a session only
+	if status := a.getWithKey(t, "/api/transaction/balance", a.apiKey(t, merchant, models.OrdersRead)); status != 401 {
+		t.Fatalf("balance with an API key: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,100 @@
+package routes_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+)
+
+type registerResult struct {
+	status int
+	err    string
+}
+
+func (a *testApp) register(username, email string) (registerResult, error) {
+	body := fiber.Map{"username": username, "password": testPassword, "role": "CLIENT"}
+	if email != "" {
+		body["email"] = email
+	}
+	res, err := a.send(http.MethodPost, "/api/auth/register", "", body)
+	if err != nil {
+		return registerResult{}, err
+	}
+	defer res.Body.Close()
+	var out struct {
+		Error interface{} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return registerResult{}, err
+	}
+	msg, _ := out.Error.(string)
+	return registerResult{res.StatusCode, msg}, nil
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	username, _ := a.signup(t, "CLIENT")
+
+	tests := []struct {
+		name     string
+		username string
+		email    string
+		want     registerResult
+	}{
+		{"no email", dbtest.Name("user"), "", registerResult{400, ""}},
+		{"taken username", username, dbtest.Name("user") + "@example.com", registerResult{409, "Username already exists"}},
+		{"taken email", dbtest.Name("user"), username + "@example.com", registerResult{409, "Email already registered"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.register(tt.username, tt.email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentRegisterSameEmail(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	email := dbtest.Name("user") + "@example.com"
+
+	const attempts = 10
+	results := make([]registerResult, attempts)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// t.Fatal must not be called off the test goroutine
+			r, err := a.register(dbtest.Name("user"), email)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = r
+		}(i)
+	}
+	wg.Wait()
+
+	// whether the losers are caught by the check or by the constraint,
+	// they are told it's the email
+	created := 0
+	for _, r := range results {
+		switch {
+		case r.status == 200:
+			created++
+		case r.status != 409 || r.err != "Email already registered":
+			t.Errorf("got %+v, want 409 Email already registered", r)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d users registered with one email, want 1", created)
+	}
+}
@@ -0,0 +1,152 @@
+package routes_test
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+type loginResult struct {
+	status     int
+	body       string
+	retryAfter int
+}
+
+func (a *testApp) tryLogin(t *testing.T, username, password string) loginResult {
+	t.Helper()
+	res, err := a.send(http.MethodPost, "/api/auth/login", "", fiber.Map{"username": username, "password": password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryAfter, _ := strconv.Atoi(res.Header.Get(fiber.HeaderRetryAfter))
+	return loginResult{res.StatusCode, string(body), retryAfter}
+}
+
+// lockouts counts the lockout audit events of a throttle key.
+func (a *testApp) lockouts(t *testing.T, key string) int64 {
+	t.Helper()
+	var n int64
+	if err := a.services.DB.Model(&models.AuditEvent{}).
+		Where("action = ? AND subject = ?", models.AuditLoginLockout, key).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLoginLockoutPerUsername(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	auth := a.services.Config.Auth
+	username, _ := a.signup(t, "CLIENT")
+	unknown := dbtest.Name("nobody")
+
+	// a wrong password and an unknown username look the same, before and
+	// after the lock
+	for i := 0; i < auth.LoginMaxAttempts; i++ {
+		wrong := a.tryLogin(t, username, "wrong-password")
+		missing := a.tryLogin(t, unknown, "wrong-password")
+		if wrong.status != 401 || wrong != missing {
+			t.Fatalf("failure %d: %+v for a wrong password, %+v for an unknown user", i+1, wrong, missing)
+		}
+	}
+	locked := a.tryLogin(t, username, testPassword)
+	missing := a.tryLogin(t, unknown, testPassword)
+	if locked.status != 429 || locked.body != missing.body || locked.status != missing.status {
+		t.Fatalf("locked: %+v for the user, %+v for an unknown user", locked, missing)
+	}
+	if want := int(auth.LoginLockout.Seconds()); locked.retryAfter < want || locked.retryAfter > want+1 {
+		t.Fatalf("Retry-After is %d, want about %d", locked.retryAfter, want)
+	}
+
+	// each failure past the limit locks for twice as long
+	lockout := auth.LoginLockout
+	for i := 0; i < 2; i++ {
+		a.clock.Advance(lockout)
+		lockout *= 2
+		if r := a.tryLogin(t, username, "wrong-password"); r.status != 401 {
+			t.Fatalf("failure after the lock: status %d, want 401", r.status)
+		}
+		r := a.tryLogin(t, username, testPassword)
+		if want := int(lockout.Seconds()); r.status != 429 || r.retryAfter < want || r.retryAfter > want+1 {
+			t.Fatalf("lock %d: %+v, want 429 for about %ds", i+2, r, want)
+		}
+	}
+	if n := a.lockouts(t, "user:"+username); n != 3 {
+		t.Fatalf("%d lockouts audited, want 3", n)
+	}
+
+	// a login once the lock is over forgets the failures
+	a.clock.Advance(lockout)
+	if r := a.tryLogin(t, username, testPassword); r.status != 200 {
+		t.Fatalf("login after the lock: status %d", r.status)
+	}
+	if r := a.tryLogin(t, username, "wrong-password"); r.status != 401 {
+		t.Fatalf("failure after logging in: status %d, want 401", r.status)
+	}
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	a.services.Config.Auth.LoginIPMaxAttempts = 3
+	username, _ := a.signup(t, "CLIENT")
+
+	// guesses spread over usernames still count against the address
+	for i := 0; i < 3; i++ {
+		if r := a.tryLogin(t, dbtest.Name("nobody"), "wrong-password"); r.status != 401 {
+			t.Fatalf("failure %d: status %d, want 401", i+1, r.status)
+		}
+	}
+	if r := a.tryLogin(t, username, testPassword); r.status != 429 {
+		t.Fatalf("login from the locked address: status %d, want 429", r.status)
+	}
+	if n := a.lockouts(t, "ip:"+a.ip); n != 1 {
+		t.Fatalf("%d lockouts audited for the address, want 1", n)
+	}
+
+	a.ip = randomIP()
+	if r := a.tryLogin(t, username, testPassword); r.status != 200 {
+		t.Fatalf("login from another address: status %d", r.status)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	username, token := a.signup(t, "CLIENT")
+	staff, admin := a.staff(t)
+
+	for i := 0; i < a.services.Config.Auth.LoginMaxAttempts; i++ {
+		a.tryLogin(t, username, "wrong-password")
+	}
+	if r := a.tryLogin(t, username, testPassword); r.status != 429 {
+		t.Fatalf("locked login: status %d, want 429", r.status)
+	}
+
+	path := "/api/admin/users/" + username + "/unlock"
+	if status := a.do(t, http.MethodPost, path, token, nil, nil); status != 401 {
+		t.Fatalf("unlock by the user: status %d, want 401", status)
+	}
+	if status := a.do(t, http.MethodPost, path, admin, nil, nil); status != 200 {
+		t.Fatalf("unlock: status %d", status)
+	}
+	if r := a.tryLogin(t, username, testPassword); r.status != 200 {
+		t.Fatalf("login after the unlock: status %d", r.status)
+	}
+
+	var event models.AuditEvent
+	if err := a.services.DB.Where("action = ? AND subject = ?", models.AuditLoginUnlock, "user:"+username).
+		First(&event).Error; err != nil {
+		t.Fatal(err)
+	}
+	if event.Actor == nil || *event.Actor != staff {
+		t.Fatalf("unlock audited for %v, want %s", event.Actor, staff)
+	}
+}
@@ -0,0 +1,280 @@
+package routes_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+// createProduct lists a stock-tracked product of the merchant token belongs
+// to and returns its code.
+func (a *testApp) createProduct(t *testing.T, token string, price models.Money, stock int) string {
+	t.Helper()
+	// codes are stored upper case
+	code := strings.ToUpper(dbtest.Name("P"))
+	if status := a.do(t, http.MethodPost, "/api/product", token, fiber.Map{
+		"code":   code,
+		"name":   "Test product",
+		"price":  price.String(),
+		"weight": 1,
+		"stock":  stock,
+	}, nil); status != 201 {
+		t.Fatalf("create product: status %d", status)
+	}
+	return code
+}
+
+func (a *testApp) topup(t *testing.T, token string, amount models.Money) {
+	t.Helper()
+	if status := a.do(t, http.MethodPost, "/api/transaction/topup", token, fiber.Map{"amount": amount.String()}, nil); status != 201 {
+		t.Fatalf("topup: status %d", status)
+	}
+}
+
+func (a *testApp) balance(t *testing.T, token string) models.Money {
+	t.Helper()
+	var balance struct {
+		Balance models.Money `json:"balance"`
+	}
+	if status := a.do(t, http.MethodGet, "/api/transaction/balance", token, nil, &balance); status != 200 {
+		t.Fatalf("balance: status %d", status)
+	}
+	return balance.Balance
+}
+
+// pay buys qty of the product with code and returns the invoice.
+func (a *testApp) pay(t *testing.T, token, code string, qty int) string {
+	t.Helper()
+	var payment struct {
+		Data struct {
+			Invoice string `json:"invoice"`
+		} `json:"data"`
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/payment", token, fiber.Map{"code": code, "qty": qty}, &payment); status != 201 {
+		t.Fatalf("payment: status %d", status)
+	}
+	return payment.Data.Invoice
+}
+
+func TestConcurrentPayments(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	_, client := a.signup(t, "CLIENT")
+
+	const attempts = 20
+	price := models.NewMoney(30000)
+	funds := models.NewMoney(100000)
+	code := a.createProduct(t, merchant, price, attempts)
+	a.topup(t, client, funds)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, attempts)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// t.Fatal must not be called off the test goroutine
+			res, err := a.send(http.MethodPost, "/api/transaction/payment", client, fiber.Map{"code": code, "qty": 1})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	paid := 0
+	for _, status := range statuses {
+		switch status {
+		case 201:
+			paid++
+		case 400, 0:
+		default:
+			t.Errorf("payment: status %d, want 201 or 400", status)
+		}
+	}
+	if want := int(funds / price); paid != want {
+		t.Fatalf("%d payments succeeded, want %d", paid, want)
+	}
+
+	balance := a.balance(t, client)
+	if balance < 0 {
+		t.Fatalf("balance is %s", balance)
+	}
+	if want := funds - models.Money(paid)*price; balance != want {
+		t.Fatalf("balance is %s, want %s", balance, want)
+	}
+}
+
+func TestCancelRestoresStock(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	buyer, client := a.signup(t, "CLIENT")
+	db := a.services.DB
+
+	price := models.NewMoney(10000)
+	funds := models.NewMoney(100000)
+	code := a.createProduct(t, merchant, price, 5)
+	a.topup(t, client, funds)
+
+	var payment struct {
+		Data struct {
+			Invoice string `json:"invoice"`
+		} `json:"data"`
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/payment", client, fiber.Map{"code": code, "qty": 2}, &payment); status != 201 {
+		t.Fatalf("payment: status %d", status)
+	}
+	path := "/api/orders/" + payment.Data.Invoice + "/status"
+	if status := a.do(t, http.MethodPatch, path, client, fiber.Map{"status": models.Cancelled}, nil); status != 200 {
+		t.Fatalf("cancel: status %d", status)
+	}
+
+	var product models.Product
+	if err := db.Where(&models.Product{Code: code}).First(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock == nil || *product.Stock != 5 {
+		t.Fatalf("stock is %v after the cancel, want 5", product.Stock)
+	}
+
+	var purchase models.Order
+	if err := db.Where(&models.Order{Invoice: payment.Data.Invoice}).First(&purchase).Error; err != nil {
+		t.Fatal(err)
+	}
+	if purchase.Status != models.Cancelled {
+		t.Fatalf("order is %s, want %s", purchase.Status, models.Cancelled)
+	}
+
+	// the sale and its release, both tied to the order
+	var movements []models.StockMovement
+	if err := db.Where("product_code = ? AND order_id = ?", code, purchase.ID).Order("id").Find(&movements).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []models.StockMovement{
+		{Delta: -2, StockAfter: 3, Reason: "sale", Actor: buyer},
+		{Delta: 2, StockAfter: 5, Reason: "cancelled", Actor: buyer},
+	}
+	if len(movements) != len(want) {
+		t.Fatalf("%d stock movements, want %d", len(movements), len(want))
+	}
+	for i, m := range movements {
+		if m.Delta != want[i].Delta || m.StockAfter != want[i].StockAfter || m.Reason != want[i].Reason || m.Actor != want[i].Actor {
+			t.Errorf("movement %d is %+v, want %+v", i, m, want[i])
+		}
+	}
+
+	if balance := a.balance(t, client); balance != funds {
+		t.Fatalf("balance is %s after the cancel, want %s", balance, funds)
+	}
+	// a cancelled order stays cancelled, and its stock is not released twice
+	if status := a.do(t, http.MethodPatch, path, client, fiber.Map{"status": models.Cancelled}, nil); status != 409 {
+		t.Fatalf("second cancel: status %d, want 409", status)
+	}
+}
+
+func TestMerchantCannotChangeSharedOrder(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, first := a.signup(t, "MERCHANT")
+	_, second := a.signup(t, "MERCHANT")
+	_, client := a.signup(t, "CLIENT")
+
+	price := models.NewMoney(10000)
+	a.topup(t, client, models.NewMoney(100000))
+	for _, merchant := range []string{first, second} {
+		code := a.createProduct(t, merchant, price, 5)
+		if status := a.do(t, http.MethodPost, "/api/cart", client, fiber.Map{"code": code, "qty": 1}, nil); status != 200 {
+			t.Fatalf("add to cart: status %d", status)
+		}
+	}
+	var checkout struct {
+		Data struct {
+			Invoice string `json:"invoice"`
+		} `json:"data"`
+	}
+	if status := a.do(t, http.MethodPost, "/api/cart/checkout", client, nil, &checkout); status != 201 {
+		t.Fatalf("checkout: status %d", status)
+	}
+	path := "/api/orders/" + checkout.Data.Invoice + "/status"
+
+	// neither merchant speaks for the other's share
+	for _, status := range []models.OrderStatus{models.Cancelled, models.Fulfilled} {
+		if code := a.do(t, http.MethodPatch, path, first, fiber.Map{"status": status}, nil); code != 401 {
+			t.Fatalf("%s by one merchant: status %d, want 401", status, code)
+		}
+	}
+	if balance := a.balance(t, second); balance != price {
+		t.Fatalf("other merchant's balance is %s, want %s", balance, price)
+	}
+
+	// the buyer still can cancel the whole order
+	if code := a.do(t, http.MethodPatch, path, client, fiber.Map{"status": models.Cancelled}, nil); code != 200 {
+		t.Fatalf("cancel by the buyer: status %d", code)
+	}
+	for _, merchant := range []string{first, second} {
+		if balance := a.balance(t, merchant); balance != 0 {
+			t.Fatalf("merchant's balance is %s after the cancel, want 0", balance)
+		}
+	}
+}
+
+func (a *testApp) createVariant(t *testing.T, token, code, sku string, price models.Money, stock int) {
+	t.Helper()
+	if status := a.do(t, http.MethodPost, "/api/product/"+code+"/variants", token, fiber.Map{
+		"sku":     sku,
+		"name":    "Test variant",
+		"price":   price.String(),
+		"options": fiber.Map{"size": "M"},
+		"stock":   stock,
+	}, nil); status != 201 {
+		t.Fatalf("create variant: status %d", status)
+	}
+}
+
+func TestCancelAfterSKUReused(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	_, client := a.signup(t, "CLIENT")
+	db := a.services.DB
+
+	price := models.NewMoney(10000)
+	a.topup(t, client, models.NewMoney(100000))
+	sku := strings.ToUpper(dbtest.Name("SKU"))
+	sold := a.createProduct(t, merchant, price, 0)
+	a.createVariant(t, merchant, sold, sku, price, 5)
+
+	var payment struct {
+		Data struct {
+			Invoice string `json:"invoice"`
+		} `json:"data"`
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/payment", client, fiber.Map{"sku": sku, "qty": 2}, &payment); status != 201 {
+		t.Fatalf("payment: status %d", status)
+	}
+
+	// the SKU moves to a variant of another product
+	if status := a.do(t, http.MethodDelete, "/api/product/"+sold+"/variants/"+sku, merchant, nil, nil); status != 200 {
+		t.Fatalf("delete variant: status %d", status)
+	}
+	other := a.createProduct(t, merchant, price, 0)
+	a.createVariant(t, merchant, other, sku, price, 5)
+
+	if status := a.do(t, http.MethodPatch, "/api/orders/"+payment.Data.Invoice+"/status", client, fiber.Map{"status": models.Cancelled}, nil); status != 200 {
+		t.Fatalf("cancel: status %d", status)
+	}
+
+	var variant models.ProductVariant
+	if err := db.Where("sku = ?", sku).First(&variant).Error; err != nil {
+		t.Fatal(err)
+	}
+	if variant.Stock == nil || *variant.Stock != 5 {
+		t.Fatalf("stock of the new variant is %v after the cancel, want 5", variant.Stock)
+	}
+}
@@ -0,0 +1,37 @@
+package routes_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+func TestCreateAndDeleteProduct(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	_, other := a.signup(t, "MERCHANT")
+
+	code := a.createProduct(t, merchant, models.NewMoney(10000), 5)
+	if status := a.do(t, http.MethodPost, "/api/product", merchant, fiber.Map{
+		"code":   code,
+		"name":   "Test product",
+		"price":  "10000",
+		"weight": 1,
+	}, nil); status != 409 {
+		t.Fatalf("create with a taken code: status %d, want 409", status)
+	}
+
+	path := "/api/product/" + code
+	if status := a.do(t, http.MethodDelete, path, other, nil, nil); status != 401 {
+		t.Fatalf("delete by another merchant: status %d, want 401", status)
+	}
+	if status := a.do(t, http.MethodDelete, path, merchant, nil, nil); status != 200 {
+		t.Fatalf("delete: status %d", status)
+	}
+	if status := a.do(t, http.MethodGet, path, "", nil, nil); status != 404 {
+		t.Fatalf("get after delete: status %d, want 404", status)
+	}
+}
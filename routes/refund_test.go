@@ -0,0 +1,98 @@
+package routes_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+type refundResult struct {
+	Data struct {
+		Amount     models.Money `json:"amount"`
+		Refundable models.Money `json:"refundable"`
+	} `json:"data"`
+}
+
+func TestPartialRefunds(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	_, client := a.signup(t, "CLIENT")
+
+	price := models.NewMoney(10000)
+	funds := models.NewMoney(100000)
+	code := a.createProduct(t, merchant, price, 10)
+	a.topup(t, client, funds)
+	invoice := a.pay(t, client, code, 3)
+
+	var partial refundResult
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, fiber.Map{"invoice": invoice, "amount": price.String()}, &partial); status != 201 {
+		t.Fatalf("partial refund: status %d", status)
+	}
+	if partial.Data.Amount != price || partial.Data.Refundable != 2*price {
+		t.Fatalf("partial refund of %s leaves %s, want %s leaving %s", partial.Data.Amount, partial.Data.Refundable, price, 2*price)
+	}
+
+	// more than is left is refused, and refunds nothing
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, fiber.Map{"invoice": invoice, "amount": (3 * price).String()}, nil); status != 400 {
+		t.Fatalf("over-refund: status %d, want 400", status)
+	}
+
+	// without an amount, the remainder
+	var rest refundResult
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, fiber.Map{"invoice": invoice}, &rest); status != 201 {
+		t.Fatalf("refund of the remainder: status %d", status)
+	}
+	if rest.Data.Amount != 2*price || rest.Data.Refundable != 0 {
+		t.Fatalf("remainder refund of %s leaves %s, want %s leaving 0", rest.Data.Amount, rest.Data.Refundable, 2*price)
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, fiber.Map{"invoice": invoice}, nil); status == 201 {
+		t.Fatal("a fully refunded order was refunded again")
+	}
+
+	if balance := a.balance(t, client); balance != funds {
+		t.Fatalf("buyer's balance is %s, want %s", balance, funds)
+	}
+	if balance := a.balance(t, merchant); balance != 0 {
+		t.Fatalf("merchant's balance is %s, want 0", balance)
+	}
+}
+
+func TestRefundOverride(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	_, merchant := a.signup(t, "MERCHANT")
+	buyer, client := a.signup(t, "CLIENT")
+	_, admin := a.staff(t)
+
+	price := models.NewMoney(10000)
+	code := a.createProduct(t, merchant, price, 10)
+	a.topup(t, client, models.NewMoney(100000))
+	invoice := a.pay(t, client, code, 2)
+
+	// the merchant has spent its revenue
+	if status := a.do(t, http.MethodPost, "/api/transaction/transfer", merchant, fiber.Map{"recipient": buyer, "amount": (2 * price).String()}, nil); status != 201 {
+		t.Fatalf("transfer: status %d", status)
+	}
+
+	refund := fiber.Map{"invoice": invoice}
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, refund, nil); status != 400 {
+		t.Fatalf("refund without the balance: status %d, want 400", status)
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", admin, refund, nil); status != 400 {
+		t.Fatalf("staff refund without override: status %d, want 400", status)
+	}
+
+	// only staff may override
+	override := fiber.Map{"invoice": invoice, "override": true}
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", merchant, override, nil); status != 401 {
+		t.Fatalf("merchant override: status %d, want 401", status)
+	}
+	if status := a.do(t, http.MethodPost, "/api/transaction/refund", admin, override, nil); status != 201 {
+		t.Fatalf("staff override: status %d", status)
+	}
+	if balance := a.balance(t, merchant); balance != -2*price {
+		t.Fatalf("merchant's balance is %s after the override, want %s", balance, -2*price)
+	}
+}
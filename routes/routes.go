@@ -4,31 +4,116 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/ilhamosaurus/fiber-commerce/handler"
 	"github.com/ilhamosaurus/fiber-commerce/middleware"
+	"github.com/ilhamosaurus/fiber-commerce/models"
 )
 
-func SetupRoutes(app *fiber.App) {
+// SetupRoutes serves s on app, guarded with s's keys and database.
+func SetupRoutes(app *fiber.App, s *handler.Services) {
+	guard := middleware.NewGuard(s.DB, s.Keys, s.Config.JWT, s.Now)
+	idempotent := middleware.Idempotency(s.DB, s.Config.Limits.IdempotencyTTL, s.Config.Limits.IdempotencyLease, s.Now)
+
+	app.Get("/.well-known/jwks.json", s.Auth.JWKS)
 
 	// api global set prefix
 	api := app.Group("/api")
 
 	// auth routes
 	auth := api.Group("/auth")
-	auth.Post("/register", handler.Register)
-	auth.Post("/login", handler.Login)
+	auth.Post("/register", s.Auth.Register)
+	auth.Post("/login", s.Auth.Login)
+	auth.Post("/refresh", s.Auth.Refresh)
+	auth.Post("/logout", guard.Protected(), s.Auth.Logout)
+	auth.Post("/logout/all", guard.Protected(), s.Auth.LogoutAll)
+	auth.Post("/2fa/enroll", guard.Protected(), s.Auth.EnrollTwoFactor)
+	auth.Post("/2fa/enable", guard.Protected(), s.Auth.EnableTwoFactor)
+	auth.Post("/2fa/disable", guard.Protected(), s.Auth.DisableTwoFactor)
+	auth.Post("/2fa/recovery-codes", guard.Protected(), s.Auth.RegenerateRecoveryCodes)
+	auth.Post("/2fa/verify", s.Auth.VerifyTwoFactor)
+	auth.Put("/email", guard.Protected(), s.Auth.ChangeEmail)
+	auth.Post("/verify-email", s.Auth.VerifyEmail)
+	auth.Post("/verify-email/resend", guard.Protected(), s.Auth.ResendVerificationEmail)
+	auth.Post("/forgot-password", s.Auth.ForgotPassword)
+	auth.Post("/reset-password", s.Auth.ResetPassword)
 
 	// product routes
 	product := api.Group("/product")
-	product.Get("/", handler.GetAllProducts)
-	product.Get("/:code", handler.GetProduct)
-	product.Post("/", middleware.Protected(), handler.CreateProduct)
-	product.Put("/:code", middleware.Protected(), handler.UpdateProduct)
-	product.Delete("/:code", middleware.Protected(), handler.DeleteProduct)
+	product.Get("/", s.Catalog.GetAllProducts)
+	product.Get("/:code", s.Catalog.GetProduct)
+	product.Post("/", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.CreateProduct)
+	product.Put("/:code", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.UpdateProduct)
+	product.Delete("/:code", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.DeleteProduct)
+	product.Post("/:code/stock", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.AdjustStock)
+	product.Put("/:code/categories", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.SetProductCategories)
+	product.Post("/:code/variants", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.CreateVariant)
+	product.Put("/:code/variants/:sku", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.UpdateVariant)
+	product.Delete("/:code/variants/:sku", guard.Protected(models.ProductsWrite), middleware.Require(models.ProductWriteOwn), s.Catalog.DeleteVariant)
+
+	// category routes
+	category := api.Group("/category")
+	category.Get("/", s.Catalog.GetCategories)
+	category.Get("/:slug", s.Catalog.GetCategory)
+	category.Get("/:slug/products", s.Catalog.GetCategoryProducts)
+	category.Post("/", guard.Protected(), middleware.Require(models.CategoryWrite), s.Catalog.CreateCategory)
+	category.Put("/:slug", guard.Protected(), middleware.Require(models.CategoryWrite), s.Catalog.UpdateCategory)
+	category.Delete("/:slug", guard.Protected(), middleware.Require(models.CategoryWrite), s.Catalog.DeleteCategory)
 
 	// transaction routes
 	transaction := api.Group("/transaction")
-	transaction.Use(middleware.Protected())
-	transaction.Get("/balance", handler.GetBalance)
-	transaction.Post("/topup", handler.Topup)
-	transaction.Get("/history", handler.GetOrders)
-	transaction.Post("/payment", handler.Payment)
+	transaction.Get("/balance", guard.Protected(), s.Accounts.GetBalance)
+	transaction.Post("/topup", guard.Protected(), idempotent, s.Orders.Topup)
+	// readable with an API key, so a back office can sync its orders
+	transaction.Get("/history", guard.Protected(models.OrdersRead), s.Orders.GetOrders)
+	transaction.Post("/payment", guard.Protected(), idempotent, s.Orders.Payment)
+	transaction.Post("/refund", guard.Protected(), idempotent, s.Orders.Refund)
+	transaction.Post("/transfer", guard.Protected(), idempotent, s.Accounts.Transfer)
+
+	// bill routes
+	bill := api.Group("/bill")
+	bill.Use(guard.Protected())
+	bill.Post("/inquiry", s.Billing.BillInquiry)
+	bill.Post("/pay", idempotent, s.Billing.PayBill)
+
+	// subscription routes
+	subscription := api.Group("/subscription")
+	subscription.Use(guard.Protected())
+	subscription.Get("/", s.Billing.GetSubscriptions)
+	subscription.Post("/", idempotent, s.Billing.Subscribe)
+	subscription.Get("/:id", s.Billing.GetSubscription)
+	subscription.Post("/:id/cancel", s.Billing.CancelSubscription)
+	subscription.Post("/:id/pause", s.Billing.PauseSubscription)
+	subscription.Post("/:id/resume", s.Billing.ResumeSubscription)
+	subscription.Put("/:id/plan", s.Billing.ChangeSubscriptionPlan)
+
+	// order routes
+	orders := api.Group("/orders")
+	orders.Get("/:invoice", guard.Protected(models.OrdersRead), s.Orders.GetOrder)
+	orders.Patch("/:invoice/status", guard.Protected(models.OrdersWrite), s.Orders.UpdateOrderStatus)
+
+	// cart routes
+	cart := api.Group("/cart")
+	cart.Use(guard.Protected())
+	cart.Get("/", s.Orders.GetCart)
+	cart.Post("/", s.Orders.AddCartItem)
+	cart.Post("/checkout", idempotent, s.Orders.Checkout)
+	cart.Put("/:code", s.Orders.UpdateCartItem)
+	cart.Delete("/:code", s.Orders.RemoveCartItem)
+
+	// api key routes, for access tokens only
+	apiKeys := api.Group("/keys")
+	apiKeys.Use(guard.Protected(), middleware.Require(models.APIKeyManage))
+	apiKeys.Get("/", s.Auth.GetAPIKeys)
+	apiKeys.Post("/", s.Auth.CreateAPIKey)
+	apiKeys.Delete("/:id", s.Auth.RevokeAPIKey)
+
+	// admin routes
+	admin := api.Group("/admin")
+	admin.Use(guard.Protected())
+	admin.Get("/users", middleware.Require(models.UserRead), s.Admin.GetUsers)
+	admin.Get("/users/:username", middleware.Require(models.UserRead), s.Admin.GetUser)
+	admin.Put("/users/:username/role", middleware.Require(models.UserRoleWrite), s.Admin.ChangeUserRole)
+	admin.Post("/users/:username/suspend", middleware.Require(models.UserSuspend), s.Admin.SuspendUser)
+	admin.Post("/users/:username/unsuspend", middleware.Require(models.UserSuspend), s.Admin.UnsuspendUser)
+	admin.Post("/users/:username/unlock", middleware.Require(models.UserSuspend), s.Admin.UnlockUser)
+	admin.Post("/accounts/:username/adjust", middleware.Require(models.AccountAdjust), idempotent, s.Admin.AdjustBalance)
+	admin.Get("/ledger/check", middleware.Require(models.LedgerCheck), s.Admin.CheckLedger)
 }
@@ -0,0 +1,265 @@
+package routes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/biller"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/handler"
+	"github.com/ilhamosaurus/fiber-commerce/invoice"
+	"github.com/ilhamosaurus/fiber-commerce/mailer"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/routes"
+	"github.com/ilhamosaurus/fiber-commerce/signing"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+	"gorm.io/gorm"
+)
+
+const testPassword = "secret-password"
+
+// fakeClock is a clock tests move by hand.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// mockMailer keeps the messages it is asked to send.
+type mockMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *mockMailer) Send(msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// token returns the token of the last message sent to to.
+func (m *mockMailer) token(t *testing.T, to string) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To != to {
+			continue
+		}
+		_, rest, ok := strings.Cut(m.sent[i].Body, "Your token: ")
+		if !ok {
+			t.Fatalf("message to %s has no token: %q", to, m.sent[i].Body)
+		}
+		token, _, _ := strings.Cut(rest, "\n")
+		return token
+	}
+	t.Fatalf("no message sent to %s", to)
+	return ""
+}
+
+type testApp struct {
+	app      *fiber.App
+	clock    *fakeClock
+	mail     *mockMailer
+	services *handler.Services
+	// ip is the client address requests come from, random so that the
+	// login throttles of one test do not lock out another
+	ip string
+}
+
+// newTestApp serves the routes over db, which may be nil for tests that
+// never reach the database, with a fake clock and a mock mailer.
+func newTestApp(t *testing.T, db *gorm.DB) *testApp {
+	t.Helper()
+	key, err := signing.Generate("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := signing.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Server.ProxyHeader = fiber.HeaderXForwardedFor
+	jakarta, err := time.LoadLocation(cfg.Invoice.Timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	mail := &mockMailer{}
+	services := handler.New(handler.Deps{
+		DB:     db,
+		Config: cfg,
+		Keys:   keys,
+		Mailer: mail,
+		Invoices: &invoice.Generator{
+			Format:     "{prefix}{date}-{ns}-{seq}",
+			Prefix:     dbtest.Name("T"),
+			DateLayout: cfg.Invoice.DateFormat,
+			Padding:    cfg.Invoice.Padding,
+			Location:   jakarta,
+			Now:        clock.Now,
+		},
+		Billers:  biller.NewRegistry(),
+		Now:      clock.Now,
+		Location: jakarta,
+	})
+	app := fiber.New(fiber.Config{ProxyHeader: cfg.Server.ProxyHeader})
+	routes.SetupRoutes(app, services)
+	return &testApp{app: app, clock: clock, mail: mail, services: services, ip: randomIP()}
+}
+
+func randomIP() string {
+	return fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256))
+}
+
+// send sends body as JSON with token as the bearer, when given.
+func (a *testApp) send(method, path, token string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fiber.HeaderXForwardedFor, a.ip)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.app.Test(req, -1)
+}
+
+// do sends the request like send and decodes the response into out, when
+// given.
+func (a *testApp) do(t *testing.T, method, path, token string, body, out interface{}) int {
+	t.Helper()
+	res, err := a.send(method, path, token, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding the response: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// signup registers a user with role and logs them in, returning the
+// username and access token.
+func (a *testApp) signup(t *testing.T, role string) (string, string) {
+	t.Helper()
+	username := dbtest.Name("user")
+	if code := a.do(t, http.MethodPost, "/api/auth/register", "", fiber.Map{
+		"username": username,
+		"password": testPassword,
+		"role":     role,
+		"email":    username + "@example.com",
+	}, nil); code != 200 {
+		t.Fatalf("register: status %d", code)
+	}
+	return username, a.login(t, username)
+}
+
+// staff creates an admin, whom registration does not, and logs them in.
+func (a *testApp) staff(t *testing.T) (string, string) {
+	t.Helper()
+	username := dbtest.Name("admin")
+	hash, err := util.HashedPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.services.DB.Create(&models.User{
+		Username: username,
+		Password: hash,
+		Role:     models.Admin,
+		Account:  &models.Account{Owner: username, Currency: models.IDR},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return username, a.login(t, username)
+}
+
+func (a *testApp) login(t *testing.T, username string) string {
+	t.Helper()
+	var login struct {
+		Token string `json:"token"`
+	}
+	if code := a.do(t, http.MethodPost, "/api/auth/login", "", fiber.Map{
+		"username": username,
+		"password": testPassword,
+	}, &login); code != 200 {
+		t.Fatalf("login: status %d", code)
+	}
+	return login.Token
+}
+
+func TestJWKSAndGarbageBearer(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if code := a.do(t, http.MethodGet, "/.well-known/jwks.json", "", nil, &jwks); code != 200 {
+		t.Fatalf("jwks: status %d", code)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("jwks has %d keys, want 1", len(jwks.Keys))
+	}
+
+	if code := a.do(t, http.MethodGet, "/api/transaction/balance", "not-a-jwt", nil, nil); code != 401 {
+		t.Fatalf("garbage bearer: status %d, want 401", code)
+	}
+}
+
+func TestRegisterVerifyAndExpire(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	username, token := a.signup(t, "CLIENT")
+
+	// the verification token reaches the mailer, and works once
+	verify := fiber.Map{"token": a.mail.token(t, username+"@example.com")}
+	if code := a.do(t, http.MethodPost, "/api/auth/verify-email", "", verify, nil); code != 200 {
+		t.Fatalf("verify email: status %d", code)
+	}
+	if code := a.do(t, http.MethodPost, "/api/auth/verify-email", "", verify, nil); code != 400 {
+		t.Fatalf("verify email again: status %d, want 400", code)
+	}
+
+	if code := a.do(t, http.MethodGet, "/api/transaction/balance", token, nil, nil); code != 200 {
+		t.Fatalf("balance: status %d", code)
+	}
+
+	// the access token expires on the app's clock, not the wall clock
+	a.clock.Advance(a.services.Config.JWT.AccessTokenTTL + time.Second)
+	if code := a.do(t, http.MethodGet, "/api/transaction/balance", token, nil, nil); code != 401 {
+		t.Fatalf("balance after expiry: status %d, want 401", code)
+	}
+}
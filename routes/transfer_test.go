@@ -0,0 +1,68 @@
+package routes_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ilhamosaurus/fiber-commerce/database/dbtest"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+func (a *testApp) transfer(t *testing.T, token, recipient string, amount models.Money) int {
+	t.Helper()
+	return a.do(t, http.MethodPost, "/api/transaction/transfer", token, fiber.Map{"recipient": recipient, "amount": amount.String()}, nil)
+}
+
+func TestTransferToSelf(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	sender, token := a.signup(t, "CLIENT")
+	a.topup(t, token, models.NewMoney(1000))
+
+	if status := a.transfer(t, token, sender, models.NewMoney(100)); status != 400 {
+		t.Fatalf("transfer to self: status %d, want 400", status)
+	}
+	if balance := a.balance(t, token); balance != models.NewMoney(1000) {
+		t.Fatalf("balance is %s, want 1000.00", balance)
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	a := newTestApp(t, dbtest.Open(t))
+	perTransaction, daily := models.NewMoney(40000), models.NewMoney(50000)
+	a.services.Config.Limits.TransferMaxAmount = &perTransaction
+	a.services.Config.Limits.TransferDailyLimit = &daily
+
+	// an hour before midnight in the business timezone, which is
+	// mid-afternoon in UTC
+	jakarta := a.services.Location
+	a.clock.now = time.Date(2024, 3, 1, 23, 0, 0, 0, jakarta)
+
+	sender, token := a.signup(t, "CLIENT")
+	recipient, _ := a.signup(t, "CLIENT")
+	a.topup(t, token, models.NewMoney(200000))
+
+	if status := a.transfer(t, token, recipient, perTransaction+1); status != 400 {
+		t.Fatalf("transfer over the per-transaction limit: status %d, want 400", status)
+	}
+	if status := a.transfer(t, token, recipient, models.NewMoney(30000)); status != 201 {
+		t.Fatalf("first transfer: status %d", status)
+	}
+	if status := a.transfer(t, token, recipient, models.NewMoney(30000)); status != 400 {
+		t.Fatalf("transfer over the daily limit: status %d, want 400", status)
+	}
+	if status := a.transfer(t, token, recipient, models.NewMoney(20000)); status != 201 {
+		t.Fatalf("transfer up to the daily limit: status %d", status)
+	}
+
+	// the limit starts over at midnight in the business timezone
+	a.clock.Advance(2 * time.Hour)
+	token = a.login(t, sender)
+	if status := a.transfer(t, token, recipient, models.NewMoney(30000)); status != 201 {
+		t.Fatalf("transfer the next day: status %d", status)
+	}
+	if balance := a.balance(t, token); balance != models.NewMoney(120000) {
+		t.Fatalf("balance is %s, want 120000.00", balance)
+	}
+}
@@ -0,0 +1,243 @@
+// Package signing holds the keys access tokens are signed with. The active
+// key signs new tokens and the previous keys still verify, so rotating the
+// active key does not invalidate tokens that are still live. The public
+// halves are published as a JWKS, and verification goes through that same
+// key set.
+package signing
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type, want RSA or Ed25519")
+
+// Key is one signing key. Private is nil for a previous key loaded from its
+// public half, which can only verify.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet is the active key and the previous keys still accepted.
+type KeySet struct {
+	active *Key
+	keys   []*Key
+	jwks   []byte
+	verify *keyfunc.JWKS
+}
+
+// jwk is the JSON Web Key form of a public key, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Load builds the key set cfg describes: the private key in PrivateKeyFile,
+// or without one a key generated with SigningAlg that lasts until the
+// process exits, and the PreviousKeyFiles.
+func Load(cfg config.JWT) (*KeySet, error) {
+	var active *Key
+	if path := cfg.PrivateKeyFile; path != "" {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if key.Private == nil {
+			return nil, fmt.Errorf("%s: active key must be a private key", path)
+		}
+		active = key
+	} else {
+		key, err := Generate(cfg.SigningAlg)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("no JWT private key file configured, signing with generated key %s; tokens will not survive a restart", key.ID)
+		active = key
+	}
+
+	previous := make([]*Key, 0)
+	for _, path := range cfg.PreviousKeyFiles {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+
+	return NewKeySet(active, previous...)
+}
+
+// NewKeySet makes active the signing key, with previous still verifying.
+func NewKeySet(active *Key, previous ...*Key) (*KeySet, error) {
+	set := &KeySet{active: active, keys: []*Key{active}}
+	for _, key := range previous {
+		if key.ID != active.ID {
+			set.keys = append(set.keys, key)
+		}
+	}
+
+	published := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: make([]jwk, 0, len(set.keys))}
+	for _, key := range set.keys {
+		published.Keys = append(published.Keys, publicJWK(key))
+	}
+	raw, err := json.Marshal(published)
+	if err != nil {
+		return nil, err
+	}
+	verify, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	set.jwks, set.verify = raw, verify
+	return set, nil
+}
+
+// Generate creates a key for alg, RS256 when alg is empty.
+func Generate(alg string) (*Key, error) {
+	switch alg {
+	case "", jwt.SigningMethodRS256.Alg():
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(private)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(private)
+	default:
+		return nil, fmt.Errorf("unsupported signing alg %q, want RS256 or EdDSA", alg)
+	}
+}
+
+// readKey loads a PEM private key (PKCS#8, or PKCS#1 for RSA) or public key
+// (PKIX) from path.
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key, err := newKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newKey(parsed interface{}) (*Key, error) {
+	key := &Key{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	key.ID = thumbprint(key)
+	return key, nil
+}
+
+// thumbprint is the RFC 7638 thumbprint of the public key, used as its kid
+// so the same key always gets the same id.
+func thumbprint(key *Key) string {
+	var canonical string
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, rsaExponent(pub), encode(pub.N.Bytes()))
+	case ed25519.PublicKey:
+		canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, encode(pub))
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return encode(sum[:])
+}
+
+func publicJWK(key *Key) jwk {
+	out := jwk{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		out.Kty, out.N, out.E = "RSA", encode(pub.N.Bytes()), rsaExponent(pub)
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", encode(pub)
+	}
+	return out
+}
+
+func rsaExponent(pub *rsa.PublicKey) string {
+	return encode(big.NewInt(int64(pub.E)).Bytes())
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Sign signs claims with the active key, naming it in the kid header.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.active.Method, claims)
+	token.Header["kid"] = s.active.ID
+	return token.SignedString(s.active.Private)
+}
+
+// Keyfunc finds the key a token was signed with by its kid, for jwt.Parse.
+// Tokens whose alg does not match the key are rejected.
+func (s *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	return s.verify.Keyfunc(token)
+}
+
+// JWKS is the public key set as served on /.well-known/jwks.json.
+func (s *KeySet) JWKS() []byte {
+	return s.jwks
+}
@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of RFC 6238 Appendix B, "12345678901234567890",
+// base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// the 8 digit codes of Appendix B, of which authenticator apps keep the
+	// last 6
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name  string
+		delta int64
+		skew  int
+		ok    bool
+	}{
+		{"current step", 0, 1, true},
+		{"previous step", -1, 1, true},
+		{"next step", 1, 1, true},
+		{"two steps behind", -2, 1, false},
+		{"two steps ahead", 2, 1, false},
+		{"previous step without skew", -1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, step+tt.delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := Validate(rfcSecret, code, now, tt.skew)
+			if ok != tt.ok {
+				t.Fatalf("valid is %v, want %v", ok, tt.ok)
+			}
+			if ok && got != step+tt.delta {
+				t.Fatalf("step is %d, want %d", got, step+tt.delta)
+			}
+		})
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("code %q is valid", code)
+		}
+	}
+}
+
+// TestValidateReplay checks the step Validate returns lets a caller refuse a
+// code used before, as checkSecondFactor does by keeping the last step.
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	last := int64(0)
+	accept := func(code string, at time.Time) bool {
+		step, ok := Validate(rfcSecret, code, at, 1)
+		if !ok || step <= last {
+			return false
+		}
+		last = step
+		return true
+	}
+
+	current, _ := Code(rfcSecret, Step(now))
+	previous, _ := Code(rfcSecret, Step(now)-1)
+	if !accept(current, now) {
+		t.Fatal("current code is refused")
+	}
+	if accept(current, now) {
+		t.Fatal("current code is accepted twice")
+	}
+	// still in the skew window, but older than the code already used
+	if accept(previous, now) {
+		t.Fatal("previous code is accepted after the current one")
+	}
+	// and a step later the replayed code is still refused
+	if accept(current, now.Add(Period*time.Second)) {
+		t.Fatal("current code is accepted again a step later")
+	}
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+)
+
+var ErrInvalidClaims = errors.New("invalid token claims")
+
+// AccessTokenType is the typ claim of access tokens, so no other token
+// signed by the same keys passes for one.
+const AccessTokenType = "access"
+
+// Claims are the claims of an access token. jwt checks exp and nbf while
+// parsing and then calls Validate for the rest.
+type Claims struct {
+	Type     string      `json:"typ"`
+	Username string      `json:"username"`
+	Role     models.Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// NewClaims are the claims of an access token for user, issued by cfg's
+// issuer for its audience, identified by jti and valid from issuedAt until
+// expiresAt.
+func NewClaims(cfg config.JWT, user *models.User, jti string, issuedAt, expiresAt time.Time) *Claims {
+	return &Claims{
+		Type:     AccessTokenType,
+		Username: user.Username,
+		Role:     user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.Issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{cfg.Audience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(issuedAt),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ID:        jti,
+		},
+	}
+}
+
+// Validate requires the registered claims every access token carries.
+// Whom it was issued by and for is checked by Expect, which knows the
+// configuration.
+func (c *Claims) Validate() error {
+	switch {
+	case c.Type != AccessTokenType:
+		return fmt.Errorf("%w: token type %q is not %q", ErrInvalidClaims, c.Type, AccessTokenType)
+	case c.ID == "":
+		return fmt.Errorf("%w: missing jti", ErrInvalidClaims)
+	case c.ExpiresAt == nil:
+		return fmt.Errorf("%w: missing exp", ErrInvalidClaims)
+	case c.IssuedAt == nil:
+		return fmt.Errorf("%w: missing iat", ErrInvalidClaims)
+	case c.Username == "":
+		return fmt.Errorf("%w: missing username", ErrInvalidClaims)
+	}
+	if _, err := strconv.ParseUint(c.Subject, 10, 0); err != nil {
+		return fmt.Errorf("%w: subject %q is not a user id", ErrInvalidClaims, c.Subject)
+	}
+	return nil
+}
+
+// Expect requires the token to be issued by cfg's issuer for its audience,
+// and not later than a minute after now.
+func (c *Claims) Expect(cfg config.JWT, now time.Time) error {
+	switch {
+	case c.Issuer != cfg.Issuer:
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidClaims, c.Issuer)
+	case !slices.Contains(c.Audience, cfg.Audience):
+		return fmt.Errorf("%w: token is not for audience %q", ErrInvalidClaims, cfg.Audience)
+	case c.IssuedAt != nil && c.IssuedAt.After(now.Add(time.Minute)):
+		return fmt.Errorf("%w: future iat", ErrInvalidClaims)
+	}
+	return nil
+}
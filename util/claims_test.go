@@ -0,0 +1,67 @@
+package util_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ilhamosaurus/fiber-commerce/config"
+	"github.com/ilhamosaurus/fiber-commerce/models"
+	"github.com/ilhamosaurus/fiber-commerce/signing"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+func TestClaims(t *testing.T) {
+	key, err := signing.Generate("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := signing.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().JWT
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := &models.User{Username: "client", Role: models.Role("CLIENT")}
+	user.ID = 7
+
+	tests := []struct {
+		name   string
+		modify func(c *util.Claims)
+		want   error
+	}{
+		{"valid", func(c *util.Claims) {}, nil},
+		{"wrong typ", func(c *util.Claims) { c.Type = "refresh" }, util.ErrInvalidClaims},
+		{"missing typ", func(c *util.Claims) { c.Type = "" }, util.ErrInvalidClaims},
+		{"wrong issuer", func(c *util.Claims) { c.Issuer = "someone-else" }, util.ErrInvalidClaims},
+		{"wrong audience", func(c *util.Claims) { c.Audience = jwt.ClaimStrings{"someone-else"} }, util.ErrInvalidClaims},
+		{"expired", func(c *util.Claims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Second)) }, jwt.ErrTokenExpired},
+		{"future iat", func(c *util.Claims) { c.IssuedAt = jwt.NewNumericDate(now.Add(time.Hour)) }, util.ErrInvalidClaims},
+		{"empty subject", func(c *util.Claims) { c.Subject = "" }, util.ErrInvalidClaims},
+		{"subject not a user id", func(c *util.Claims) { c.Subject = "client" }, util.ErrInvalidClaims},
+		{"missing jti", func(c *util.Claims) { c.ID = "" }, util.ErrInvalidClaims},
+		{"missing username", func(c *util.Claims) { c.Username = "" }, util.ErrInvalidClaims},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := util.NewClaims(cfg, user, "jti", now.Add(-time.Minute), now.Add(cfg.AccessTokenTTL))
+			tt.modify(claims)
+			signed, err := keys.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// parsed the way the guard parses, which calls Validate
+			parsed := &util.Claims{}
+			parser := jwt.NewParser(jwt.WithTimeFunc(func() time.Time { return now }))
+			_, err = parser.ParseWithClaims(signed, parsed, keys.Keyfunc)
+			if err == nil {
+				err = parsed.Expect(cfg, now)
+			}
+			if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,16 @@
 package util
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UnknownUserHash is a hash of no real password, at the same cost as
+// HashedPassword. Comparing against it when a user does not exist makes that
+// as slow as a wrong password.
+const UnknownUserHash = "$2a$14$OeG2qntoM69gOykO02o1Mu2VsUiZDJOXAYRwhH/.kIiGY5xn9kaOO"
 
 func HashedPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
@@ -11,3 +21,10 @@ func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// HashToken is how random tokens and keys are stored. They carry enough
+// entropy that a plain SHA-256 cannot be reversed, and it can be looked up.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,25 +1,55 @@
 package util
 
 import (
+	"errors"
+	"strconv"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/ilhamosaurus/fiber-commerce/models"
 )
 
+var ErrNoCurrentUser = errors.New("request has no verified token")
+
+// CurUser is who a request acts for. APIKeyID and Scopes are set when it
+// came with an API key rather than an access token, which leaves TokenID and
+// ExpiresAt empty.
 type CurUser struct {
 	ID        uint
-	Username string
-	Role models.Role
+	Username  string
+	Role      models.Role
+	TokenID   string
+	ExpiresAt time.Time
+	APIKeyID  uint
+	Scopes    []models.Scope
 }
 
-func CurrentUser(c *fiber.Ctx) CurUser {
-	user := c.Locals("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
-	role := claims["role"].(string)
-	return CurUser{
-		ID:        uint(claims["id"].(float64)),
-		Username:  username,
-		Role:      models.Role(role),
+// CurrentUser returns the user of the access token or API key verified by
+// middleware.Protected. It returns an error, never panics, when the route
+// is not protected or the token's claims are not what Protected stores.
+func CurrentUser(c *fiber.Ctx) (*CurUser, error) {
+	if user, ok := c.Locals("user").(*CurUser); ok && user != nil {
+		return user, nil
+	}
+	token, ok := c.Locals("user").(*jwt.Token)
+	if !ok || token == nil || !token.Valid {
+		return nil, ErrNoCurrentUser
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, ErrInvalidClaims
 	}
-}
\ No newline at end of file
+	id, err := strconv.ParseUint(claims.Subject, 10, 0)
+	if err != nil || claims.Username == "" || claims.ExpiresAt == nil {
+		return nil, ErrInvalidClaims
+	}
+
+	return &CurUser{
+		ID:        uint(id),
+		Username:  claims.Username,
+		Role:      claims.Role,
+		TokenID:   claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
@@ -0,0 +1,70 @@
+package util_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ilhamosaurus/fiber-commerce/util"
+)
+
+func TestCurrentUser(t *testing.T) {
+	expiresAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(subject, username string) *util.Claims {
+		c := &util.Claims{Username: username}
+		c.Subject = subject
+		c.ID = "jti"
+		c.ExpiresAt = jwt.NewNumericDate(expiresAt)
+		return c
+	}
+	apiUser := &util.CurUser{ID: 3, Username: "merchant", APIKeyID: 9}
+
+	tests := []struct {
+		name   string
+		locals interface{}
+		want   *util.CurUser
+		err    error
+	}{
+		{"missing", nil, nil, util.ErrNoCurrentUser},
+		{"string", "client", nil, util.ErrNoCurrentUser},
+		{"nil token", (*jwt.Token)(nil), nil, util.ErrNoCurrentUser},
+		{"nil user", (*util.CurUser)(nil), nil, util.ErrNoCurrentUser},
+		{"unverified token", &jwt.Token{Claims: claims("7", "client")}, nil, util.ErrNoCurrentUser},
+		{"map claims", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"sub": "7"}}, nil, util.ErrInvalidClaims},
+		{"subject not a user id", &jwt.Token{Valid: true, Claims: claims("client", "client")}, nil, util.ErrInvalidClaims},
+		{"empty username", &jwt.Token{Valid: true, Claims: claims("7", "")}, nil, util.ErrInvalidClaims},
+		{"api key", apiUser, apiUser, nil},
+		{"access token", &jwt.Token{Valid: true, Claims: claims("7", "client")}, &util.CurUser{ID: 7, Username: "client", TokenID: "jti", ExpiresAt: expiresAt}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user *util.CurUser
+			var err error
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				if tt.locals != nil {
+					c.Locals("user", tt.locals)
+				}
+				user, err = util.CurrentUser(c)
+				return nil
+			})
+			if _, testErr := app.Test(httptest.NewRequest("GET", "/", nil)); testErr != nil {
+				t.Fatal(testErr)
+			}
+
+			if !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			switch {
+			case tt.want == nil && user != nil:
+				t.Fatalf("got user %+v, want none", user)
+			case tt.want != nil && (user == nil || user.ID != tt.want.ID || user.Username != tt.want.Username ||
+				user.TokenID != tt.want.TokenID || !user.ExpiresAt.Equal(tt.want.ExpiresAt) || user.APIKeyID != tt.want.APIKeyID):
+				t.Fatalf("got user %+v, want %+v", user, tt.want)
+			}
+		})
+	}
+}